@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/quasilyte/perf-heatmap/heatmap"
+)
+
+// jsonConfig is a config file representation of the heatmap.IndexConfig.
+type jsonConfig struct {
+	Threshold          float64                 `json:"threshold"`
+	MinConfidence      float64                 `json:"min_confidence"`
+	MinShare           float64                 `json:"min_share"`
+	MinValue           string                  `json:"min_value"`
+	GlobalPackages     []string                `json:"global_packages"`
+	LeafPackages       []string                `json:"leaf_packages"`
+	PruneCold          bool                    `json:"prune_cold"`
+	ThresholdOverrides []jsonThresholdOverride `json:"threshold_overrides"`
+}
+
+type jsonThresholdOverride struct {
+	PkgPath    string  `json:"pkg_path"`
+	FilePrefix string  `json:"file_prefix"`
+	Threshold  float64 `json:"threshold"`
+}
+
+// applyConfigFile loads the index config from the file.
+// Flags that were explicitly set on the command line take
+// precedence over the config file values.
+func applyConfigFile(fs *flag.FlagSet, filename string, config *heatmap.IndexConfig) error {
+	if filename == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var fileConfig jsonConfig
+	if err := json.Unmarshal(data, &fileConfig); err != nil {
+		return fmt.Errorf("parse config file: %w", err)
+	}
+
+	if fileConfig.Threshold < 0 || fileConfig.Threshold > 1 {
+		return fmt.Errorf("config file: threshold %v is not in (0, 1.0] range", fileConfig.Threshold)
+	}
+	if fileConfig.MinConfidence < 0 || fileConfig.MinConfidence >= 1 {
+		return fmt.Errorf("config file: min_confidence %v is not in [0, 1.0) range", fileConfig.MinConfidence)
+	}
+
+	if fileConfig.MinShare < 0 || fileConfig.MinShare >= 1 {
+		return fmt.Errorf("config file: min_share %v is not in [0, 1.0) range", fileConfig.MinShare)
+	}
+
+	result := heatmap.IndexConfig{
+		Threshold:      fileConfig.Threshold,
+		MinConfidence:  fileConfig.MinConfidence,
+		MinShare:       fileConfig.MinShare,
+		GlobalPackages: fileConfig.GlobalPackages,
+		LeafPackages:   fileConfig.LeafPackages,
+		PruneCold:      fileConfig.PruneCold,
+	}
+	if fileConfig.MinValue != "" {
+		minValue, err := time.ParseDuration(fileConfig.MinValue)
+		if err != nil || minValue < 0 {
+			return fmt.Errorf("config file: invalid min_value %q", fileConfig.MinValue)
+		}
+		result.MinValue = minValue
+	}
+	for _, o := range fileConfig.ThresholdOverrides {
+		if o.PkgPath == "" && o.FilePrefix == "" {
+			return errors.New("config file: threshold override should have pkg_path or file_prefix")
+		}
+		if o.Threshold <= 0 || o.Threshold > 1 {
+			return fmt.Errorf("config file: threshold override %v is not in (0, 1.0] range", o.Threshold)
+		}
+		result.ThresholdOverrides = append(result.ThresholdOverrides, heatmap.ThresholdOverride{
+			PkgPath:    o.PkgPath,
+			FilePrefix: o.FilePrefix,
+			Threshold:  o.Threshold,
+		})
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "threshold":
+			result.Threshold = config.Threshold
+		case "min-confidence":
+			result.MinConfidence = config.MinConfidence
+		case "min-share":
+			result.MinShare = config.MinShare
+		case "min-value":
+			result.MinValue = config.MinValue
+		case "global-packages":
+			result.GlobalPackages = config.GlobalPackages
+		case "leaf-packages":
+			result.LeafPackages = config.LeafPackages
+		case "prune-cold":
+			result.PruneCold = config.PruneCold
+		}
+	})
+
+	*config = result
+	return nil
+}
+
+// validateConfig checks the index config values that come from the flags.
+// The config file values are checked by the applyConfigFile.
+func validateConfig(config *heatmap.IndexConfig) error {
+	if config.Threshold < 0 || config.Threshold > 1 {
+		return fmt.Errorf("-threshold %v is not in (0, 1.0] range", config.Threshold)
+	}
+	if config.MinConfidence < 0 || config.MinConfidence >= 1 {
+		return fmt.Errorf("-min-confidence %v is not in [0, 1.0) range", config.MinConfidence)
+	}
+	if config.MinShare < 0 || config.MinShare >= 1 {
+		return fmt.Errorf("-min-share %v is not in [0, 1.0) range", config.MinShare)
+	}
+	if config.MinValue < 0 {
+		return fmt.Errorf("-min-value %v can't be negative", config.MinValue)
+	}
+	return nil
+}
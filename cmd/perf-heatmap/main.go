@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cespare/subcmd"
@@ -29,6 +32,31 @@ func main() {
 			Description: "try to build an index from a profile and print its stats",
 			Do:          statMain,
 		},
+		{
+			Name:        "packages",
+			Description: "print the profile data aggregated by packages, directories or files",
+			Do:          packagesMain,
+		},
+		{
+			Name:        "sweep",
+			Description: "print the heat levels distribution for several thresholds",
+			Do:          sweepMain,
+		},
+		{
+			Name:        "explain",
+			Description: "print the hottest stack traces that pass through a given line",
+			Do:          explainMain,
+		},
+		{
+			Name:        "graph",
+			Description: "print the heat-colored call graph in Graphviz DOT format",
+			Do:          graphMain,
+		},
+		{
+			Name:        "validate",
+			Description: "print the diagnostics of dropped profile samples and frames",
+			Do:          validateMain,
+		},
 	}
 
 	subcmd.Run(cmds)
@@ -36,7 +64,7 @@ func main() {
 
 func statMain(args []string) {
 	if err := cmdStat(args); err != nil {
-		log.Fatalf("perf-heatmap stat: error: %v", err)
+		fatal("stat", err)
 	}
 }
 
@@ -44,8 +72,23 @@ func cmdStat(args []string) error {
 	config := heatmap.IndexConfig{}
 	fs := flag.NewFlagSet("perf-heatmap stat", flag.ExitOnError)
 	fs.Float64Var(&config.Threshold, "threshold", 0.5, `take this % of top records`)
+	fs.Float64Var(&config.MinConfidence, "min-confidence", 0, `demote lines with lower confidence to level 0`)
+	fs.Float64Var(&config.MinShare, "min-share", 0, `lines with a lower share of total value are always cold`)
+	fs.DurationVar(&config.MinValue, "min-value", 0, `lines with a lower value are always cold`)
+	fs.BoolVar(&config.PruneCold, "prune-cold", false, `drop the lines that have no heat levels`)
+	flagGlobalPackages := fs.String("global-packages", "", `comma-separated list of package path prefixes for the global ranking`)
+	flagLeafPackages := fs.String("leaf-packages", "", `comma-separated list of package path prefixes that charge their flat time to callers`)
 	flagFilename := fs.String("filename", `.*`, `stat only files that match this regex`)
+	flagConfig := fs.String("config", "", `load index config from this JSON file`)
 	_ = fs.Parse(args)
+	config.GlobalPackages = splitList(*flagGlobalPackages)
+	config.LeafPackages = splitList(*flagLeafPackages)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
 
 	argv := fs.Args()
 	if len(argv) != 1 {
@@ -65,6 +108,8 @@ func cmdStat(args []string) error {
 
 	size := index.MemoryUsageApprox()
 	fmt.Printf("index size approx: %.2f MB (%d bytes)\n", float64(size)*0.000001, size)
+	compactSize := index.Compact().MemoryUsageApprox()
+	fmt.Printf("compact index size approx: %.2f MB (%d bytes)\n", float64(compactSize)*0.000001, compactSize)
 
 	currentFunc := ""
 	index.Inspect(func(s heatmap.LineStats) {
@@ -73,18 +118,157 @@ func cmdStat(args []string) error {
 		}
 		if currentFunc != s.Func.ID {
 			currentFunc = s.Func.ID
-			fmt.Printf("  func %s.%s (%s):\n", s.Func.PkgName, currentFunc, s.Func.Filename)
+			fmt.Printf("  func %s.%s (%s): %6.2fs flat %6.2fs cum L=%d FL=%d\n",
+				s.Func.PkgName, currentFunc, s.Func.Filename,
+				time.Duration(s.Func.FlatValue).Seconds(), time.Duration(s.Func.Value).Seconds(),
+				s.Func.HeatLevel, s.Func.FlatHeatLevel)
 		}
-		fmt.Printf("    line %4d: %6.2fs flat %6.2fs cum L=%d G=%d\n",
-			s.LineNum, time.Duration(s.FlatValue).Seconds(), time.Duration(s.Value).Seconds(), s.HeatLevel, s.GlobalHeatLevel)
+		fmt.Printf("    line %4d: %6.2fs flat %6.2fs cum %5d samples L=%d G=%d FL=%d FG=%d\n",
+			s.LineNum, time.Duration(s.FlatValue).Seconds(), time.Duration(s.Value).Seconds(), s.NumSamples,
+			s.HeatLevel, s.GlobalHeatLevel, s.FlatHeatLevel, s.FlatGlobalHeatLevel)
 	})
 
 	return nil
 }
 
+func packagesMain(args []string) {
+	if err := cmdPackages(args); err != nil {
+		fatal("packages", err)
+	}
+}
+
+func cmdPackages(args []string) error {
+	config := heatmap.IndexConfig{}
+	fs := flag.NewFlagSet("perf-heatmap packages", flag.ExitOnError)
+	fs.Float64Var(&config.Threshold, "threshold", 0.5, `take this % of top records`)
+	flagBy := fs.String("by", "package", `aggregation criteria: package, dir or file`)
+	flagTop := fs.Int("top", 0, `print only this number of top entries; 0 means "all"`)
+	flagConfig := fs.String("config", "", `load index config from this JSON file`)
+	_ = fs.Parse(args)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+
+	argv := fs.Args()
+	if len(argv) != 1 {
+		return errors.New("expected exactly 1 positional arg: profile filename")
+	}
+	profileFilename := argv[0]
+
+	index, err := parseProfile(profileFilename, config)
+	if err != nil {
+		return err
+	}
+
+	var stats []heatmap.AggregateStats
+	switch *flagBy {
+	case "package":
+		stats = index.PackageStats()
+	case "dir":
+		stats = index.DirStats()
+	case "file":
+		stats = index.FileStats()
+	default:
+		return fmt.Errorf("unexpected -by value: %s", *flagBy)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Value > stats[j].Value
+	})
+	if *flagTop > 0 && len(stats) > *flagTop {
+		stats = stats[:*flagTop]
+	}
+	for _, s := range stats {
+		fmt.Printf("%6.2fs flat %6.2fs cum L=%d %s\n",
+			time.Duration(s.FlatValue).Seconds(), time.Duration(s.Value).Seconds(), s.HeatLevel, s.Name)
+	}
+
+	return nil
+}
+
+func sweepMain(args []string) {
+	if err := cmdSweep(args); err != nil {
+		fatal("sweep", err)
+	}
+}
+
+func cmdSweep(args []string) error {
+	config := heatmap.IndexConfig{}
+	fs := flag.NewFlagSet("perf-heatmap sweep", flag.ExitOnError)
+	flagThresholds := fs.String("thresholds", "0.1,0.25,0.5,0.75,1.0",
+		`comma-separated list of thresholds to try`)
+	fs.Float64Var(&config.MinConfidence, "min-confidence", 0,
+		`demote lines with lower confidence to level 0`)
+	flagConfig := fs.String("config", "",
+		`load index config from this JSON file`)
+	_ = fs.Parse(args)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+
+	argv := fs.Args()
+	if len(argv) != 1 {
+		return errors.New("expected exactly 1 positional arg: profile filename")
+	}
+	profileFilename := argv[0]
+
+	var thresholds []float64
+	for _, s := range strings.Split(*flagThresholds, ",") {
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("parse -thresholds: %w", err)
+		}
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("threshold %v is not in (0, 1.0] range", threshold)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+
+	index, err := parseProfile(profileFilename, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("threshold %s | %s\n", formatLevelsHeader("L"), formatLevelsHeader("G"))
+	for _, threshold := range thresholds {
+		config.Threshold = threshold
+		var localLevels [6]int
+		var globalLevels [6]int
+		index.Relevel(config).Inspect(func(s heatmap.LineStats) {
+			localLevels[s.HeatLevel]++
+			globalLevels[s.GlobalHeatLevel]++
+		})
+		fmt.Printf("%9.2f %s | %s\n", threshold, formatLevels(localLevels), formatLevels(globalLevels))
+	}
+
+	return nil
+}
+
+func formatLevelsHeader(prefix string) string {
+	var parts []string
+	for level := 0; level <= 5; level++ {
+		parts = append(parts, fmt.Sprintf("%6s", fmt.Sprintf("%s%d", prefix, level)))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatLevels(levels [6]int) string {
+	var parts []string
+	for _, n := range levels {
+		parts = append(parts, fmt.Sprintf("%6d", n))
+	}
+	return strings.Join(parts, " ")
+}
+
 func jsonMain(args []string) {
 	if err := cmdJSON(args); err != nil {
-		log.Fatalf("perf-heatmap json: error: %v", err)
+		fatal("json", err)
 	}
 }
 
@@ -95,7 +279,27 @@ func cmdJSON(args []string) error {
 		`export to this value format`)
 	fs.Float64Var(&config.Threshold, "threshold", 0.5,
 		`take this % of top records`)
+	fs.Float64Var(&config.MinConfidence, "min-confidence", 0,
+		`demote lines with lower confidence to level 0`)
+	fs.Float64Var(&config.MinShare, "min-share", 0,
+		`lines with a lower share of total value are always cold`)
+	fs.DurationVar(&config.MinValue, "min-value", 0,
+		`lines with a lower value are always cold`)
+	flagGlobalPackages := fs.String("global-packages", "",
+		`comma-separated list of package path prefixes for the global ranking`)
+	flagLeafPackages := fs.String("leaf-packages", "",
+		`comma-separated list of package path prefixes that charge their flat time to callers`)
+	flagConfig := fs.String("config", "",
+		`load index config from this JSON file`)
 	_ = fs.Parse(args)
+	config.GlobalPackages = splitList(*flagGlobalPackages)
+	config.LeafPackages = splitList(*flagLeafPackages)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
 
 	var valueMultiplier float64
 	switch *flagValueFormat {
@@ -120,7 +324,24 @@ func cmdJSON(args []string) error {
 		return err
 	}
 
-	result := &jsonRootIndex{}
+	metadata := index.Metadata()
+	result := &jsonRootIndex{
+		Metadata: jsonMetadata{
+			ValueFormat: *flagValueFormat,
+			SampleType:  metadata.SampleType,
+			SampleUnit:  metadata.SampleUnit,
+			PeriodType:  metadata.PeriodType,
+			PeriodUnit:  metadata.PeriodUnit,
+			Period:      metadata.Period,
+			DurationNs:  int64(metadata.Duration),
+			Comments:    append([]string{}, metadata.Comments...),
+			MainBinary:  metadata.MainBinary,
+			BuildID:     metadata.BuildID,
+		},
+	}
+	if !metadata.TimeCollected.IsZero() {
+		result.Metadata.TimeCollected = metadata.TimeCollected.UTC().Format(time.RFC3339)
+	}
 
 	var filesList []*jsonFileIndex
 	filesMap := map[string]*jsonFileIndex{}
@@ -158,13 +379,16 @@ func cmdJSON(args []string) error {
 
 	result.Files = filesList
 
-	writeJSON(os.Stdout, result)
-
-	return nil
+	return writeJSON(os.Stdout, result)
 }
 
-func writeJSON(w io.Writer, root *jsonRootIndex) {
+func writeJSON(w io.Writer, root *jsonRootIndex) error {
+	metadata, err := json.MarshalIndent(root.Metadata, "\t", "\t")
+	if err != nil {
+		return err
+	}
 	fmt.Fprintf(w, "{\n")
+	fmt.Fprintf(w, "\t\"metadata\": %s,\n", metadata)
 	fmt.Fprintf(w, "\t\"files\": [\n")
 	for i, f := range root.Files {
 		fmt.Fprintf(w, "\t\t{\n")
@@ -186,10 +410,26 @@ func writeJSON(w io.Writer, root *jsonRootIndex) {
 	}
 	fmt.Fprintf(w, "\t]\n")
 	fmt.Fprintf(w, "}\n")
+	return nil
 }
 
 type jsonRootIndex struct {
-	Files []*jsonFileIndex `json:"files"`
+	Metadata jsonMetadata     `json:"metadata"`
+	Files    []*jsonFileIndex `json:"files"`
+}
+
+type jsonMetadata struct {
+	ValueFormat   string   `json:"value_format"`
+	SampleType    string   `json:"sample_type"`
+	SampleUnit    string   `json:"sample_unit"`
+	PeriodType    string   `json:"period_type"`
+	PeriodUnit    string   `json:"period_unit"`
+	Period        int64    `json:"period"`
+	DurationNs    int64    `json:"duration_ns"`
+	TimeCollected string   `json:"time_collected,omitempty"`
+	Comments      []string `json:"comments"`
+	MainBinary    string   `json:"main_binary"`
+	BuildID       string   `json:"build_id"`
 }
 
 type jsonFileIndex struct {
@@ -204,6 +444,255 @@ type jsonLine struct {
 	Value           int
 }
 
+func validateMain(args []string) {
+	if err := cmdValidate(args); err != nil {
+		fatal("validate", err)
+	}
+}
+
+func cmdValidate(args []string) error {
+	config := heatmap.IndexConfig{}
+	fs := flag.NewFlagSet("perf-heatmap validate", flag.ExitOnError)
+	flagLeafPackages := fs.String("leaf-packages", "", `comma-separated list of package path prefixes that charge their flat time to callers`)
+	flagConfig := fs.String("config", "", `load index config from this JSON file`)
+	_ = fs.Parse(args)
+	config.LeafPackages = splitList(*flagLeafPackages)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+
+	argv := fs.Args()
+	if len(argv) != 1 {
+		return errors.New("expected exactly 1 positional arg: profile filename")
+	}
+
+	data, err := os.ReadFile(argv[0])
+	if err != nil {
+		return err
+	}
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errParseProfile, err)
+	}
+
+	index := heatmap.NewIndex(config)
+	report, addErr := index.AddProfileWithReport(p)
+
+	fmt.Printf("samples: %d (%d dropped)\n", report.NumSamples, report.DroppedSamples.Total())
+	printDropCounts(report.DroppedSamples)
+	fmt.Printf("frames: %d (%d dropped)\n", report.NumFrames, report.DroppedFrames.Total())
+	printDropCounts(report.DroppedFrames)
+	fmt.Printf("unsymbolized locations: %d\n", report.UnsymbolizedLocations)
+	fmt.Printf("indexed: %d funcs, %d lines\n", report.NumFuncs, report.NumLines)
+	if len(report.TopDroppedSymbols) != 0 {
+		fmt.Printf("top dropped symbols:\n")
+		for _, sym := range report.TopDroppedSymbols {
+			fmt.Printf("  %8.2fs %6d frames  %-13s  %s\n",
+				time.Duration(sym.Value).Seconds(), sym.NumFrames, sym.Reason, sym.Name)
+		}
+	}
+
+	if addErr != nil {
+		return fmt.Errorf("add profile to index: %w", addErr)
+	}
+	return nil
+}
+
+func printDropCounts(counts heatmap.DropCounts) {
+	if counts.Total() == 0 {
+		return
+	}
+	fmt.Printf("  %s: %d\n", heatmap.DropNoPackage, counts.NoPackage)
+	fmt.Printf("  %s: %d\n", heatmap.DropLineOverflow, counts.LineOverflow)
+	fmt.Printf("  %s: %d\n", heatmap.DropUnsymbolized, counts.Unsymbolized)
+	fmt.Printf("  %s: %d\n", heatmap.DropSmallValue, counts.SmallValue)
+}
+
+func explainMain(args []string) {
+	if err := cmdExplain(args); err != nil {
+		fatal("explain", err)
+	}
+}
+
+func cmdExplain(args []string) error {
+	config := heatmap.IndexConfig{}
+	fs := flag.NewFlagSet("perf-heatmap explain", flag.ExitOnError)
+	flagStacks := fs.Int("stacks", 5, `print up to this number of stack traces`)
+	flagLeafPackages := fs.String("leaf-packages", "", `comma-separated list of package path prefixes that charge their flat time to callers`)
+	flagConfig := fs.String("config", "", `load index config from this JSON file`)
+	_ = fs.Parse(args)
+	config.LeafPackages = splitList(*flagLeafPackages)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+	if *flagStacks <= 0 {
+		return errors.New("-stacks should be positive")
+	}
+	config.StacksPerLine = *flagStacks
+
+	argv := fs.Args()
+	if len(argv) != 2 {
+		return errors.New("expected exactly 2 positional args: profile filename and file.go:line")
+	}
+	profileFilename := argv[0]
+	i := strings.LastIndexByte(argv[1], ':')
+	if i == -1 {
+		return fmt.Errorf("invalid line %q: expected file.go:line format", argv[1])
+	}
+	filename := argv[1][:i]
+	line, err := strconv.Atoi(argv[1][i+1:])
+	if err != nil {
+		return fmt.Errorf("invalid line %q: %v", argv[1], err)
+	}
+
+	index, err := parseProfile(profileFilename, config)
+	if err != nil {
+		return err
+	}
+
+	keys := index.LookupLine(filename, line)
+	if len(keys) == 0 {
+		return fmt.Errorf("%s:%d: no profile data for this line", filename, line)
+	}
+	for _, key := range keys {
+		info := index.QueryFunc(key)
+		stats := index.QueryLine(key, line)
+		fmt.Printf("%s (%s:%d): %.2fs flat %.2fs cum %d samples L=%d G=%d\n",
+			formatKey(key), info.Filename, line,
+			time.Duration(stats.FlatValue).Seconds(), time.Duration(stats.Value).Seconds(), stats.NumSamples,
+			stats.HeatLevel, stats.GlobalHeatLevel)
+		for i, trace := range index.QueryStacks(key, line, config.StacksPerLine) {
+			fmt.Printf("  stack #%d: %6.2f%% %.2fs %d samples\n",
+				i+1, trace.LineShare*100, time.Duration(trace.Value).Seconds(), trace.NumSamples)
+			for _, frame := range trace.Frames {
+				fmt.Printf("    %s %s:%d\n", formatKey(frame.Func), frame.Func.Filename, frame.Line)
+			}
+		}
+	}
+
+	return nil
+}
+
+func graphMain(args []string) {
+	if err := cmdGraph(args); err != nil {
+		fatal("graph", err)
+	}
+}
+
+func cmdGraph(args []string) error {
+	config := heatmap.IndexConfig{}
+	graphConfig := heatmap.GraphConfig{}
+	fs := flag.NewFlagSet("perf-heatmap graph", flag.ExitOnError)
+	fs.Float64Var(&config.Threshold, "threshold", 0.5, `take this % of top records`)
+	flagGlobalPackages := fs.String("global-packages", "", `comma-separated list of package path prefixes for the global ranking`)
+	flagLeafPackages := fs.String("leaf-packages", "", `comma-separated list of package path prefixes that charge their flat time to callers`)
+	flagFocus := fs.String("focus", "", `center the graph on functions that match this regex, like "pkg.(T).f"`)
+	fs.IntVar(&graphConfig.MaxDepth, "depth", 0, `max callers and callees depth around the focus; 0 means "no limit"`)
+	fs.IntVar(&graphConfig.MaxNodes, "nodes", 80, `max number of graph nodes`)
+	flagOutput := fs.String("o", "", `write the output to this file instead of stdout`)
+	flagConfig := fs.String("config", "", `load index config from this JSON file`)
+	_ = fs.Parse(args)
+	config.GlobalPackages = splitList(*flagGlobalPackages)
+	config.LeafPackages = splitList(*flagLeafPackages)
+	if err := applyConfigFile(fs, *flagConfig, &config); err != nil {
+		return err
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+	if graphConfig.MaxDepth < 0 || graphConfig.MaxNodes <= 0 {
+		return errors.New("-depth can't be negative and -nodes should be positive")
+	}
+	config.CallGraph = true
+
+	argv := fs.Args()
+	if len(argv) != 1 {
+		return errors.New("expected exactly 1 positional arg: profile filename")
+	}
+	profileFilename := argv[0]
+
+	if *flagFocus != "" {
+		focusRE, err := regexp.Compile(*flagFocus)
+		if err != nil {
+			return fmt.Errorf("compile -focus regexp: %w", err)
+		}
+		graphConfig.Focus = func(info heatmap.FuncInfo) bool {
+			return focusRE.MatchString(info.PkgName + "." + info.ID)
+		}
+	}
+
+	index, err := parseProfile(profileFilename, config)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := index.WriteDOT(&buf, graphConfig); err != nil {
+		return err
+	}
+	if *flagOutput == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(*flagOutput, buf.Bytes(), 0o644)
+}
+
+// formatKey returns a pprof-like function name.
+func formatKey(key heatmap.Key) string {
+	if key.TypeName != "" {
+		return key.PkgName + ".(" + key.TypeName + ")." + key.FuncName
+	}
+	return key.PkgName + "." + key.FuncName
+}
+
+// Exit codes that help the scripts to tell the failure kinds apart.
+// Exit code 2 is used by the flag package for the usage errors.
+const (
+	exitError              = 1
+	exitInvalidProfile     = 3
+	exitUnsupportedProfile = 4
+	exitNoSamples          = 5
+)
+
+// errParseProfile is used to wrap the profile decoding errors.
+var errParseProfile = errors.New("parse profile")
+
+func fatal(cmdName string, err error) {
+	log.Printf("perf-heatmap %s: error: %v", cmdName, err)
+	os.Exit(exitCode(err))
+}
+
+func exitCode(err error) int {
+	var typeErr *heatmap.UnsupportedSampleTypeError
+	switch {
+	case errors.Is(err, errParseProfile), errors.Is(err, heatmap.ErrInvalidProfile):
+		return exitInvalidProfile
+	case errors.As(err, &typeErr):
+		return exitUnsupportedProfile
+	case errors.Is(err, heatmap.ErrNoSamples):
+		return exitNoSamples
+	default:
+		return exitError
+	}
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
 func parseProfile(profileFilename string, config heatmap.IndexConfig) (*heatmap.Index, error) {
 	data, err := os.ReadFile(profileFilename)
 	if err != nil {
@@ -212,7 +701,7 @@ func parseProfile(profileFilename string, config heatmap.IndexConfig) (*heatmap.
 
 	p, err := profile.Parse(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("parse profile: %w", err)
+		return nil, fmt.Errorf("%w: %v", errParseProfile, err)
 	}
 
 	index := heatmap.NewIndex(config)
@@ -3,8 +3,10 @@ module github.com/quasilyte/perf-heatmap
 go 1.17
 
 require (
-	github.com/cespare/subcmd v1.1.0 // indirect
-	github.com/google/go-cmp v0.5.6 // indirect
-	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd // indirect
-	github.com/quasilyte/pprofutil v0.0.0-20220125111125-7b67e07006e9 // indirect
+	github.com/cespare/subcmd v1.1.0
+	github.com/google/go-cmp v0.5.6
+	github.com/google/pprof v0.0.0-20211214055906-6f57359322fd
+	github.com/quasilyte/pprofutil v0.0.0-20220125111125-7b67e07006e9
 )
+
+require golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
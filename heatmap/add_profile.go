@@ -1,243 +1,702 @@
 package heatmap
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"math"
 	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/quasilyte/pprofutil"
 )
 
-func addProfile(index *Index, p *profile.Profile) error {
+func addProfile(ctx context.Context, index *Index, p *profile.Profile, progress ProgressFunc) (*Report, error) {
 	w := &profileWalker{
-		index: index,
-		p:     p,
+		index:    index,
+		p:        p,
+		report:   newReportCollector(),
+		progress: &progressTracker{ctx: ctx, callback: progress},
 	}
-	return w.Walk()
+	w.report.CountLocations(p)
+	err := w.Walk()
+	return w.report.Finish(), err
 }
 
 type profileWalker struct {
-	index *Index
-	p     *profile.Profile
+	index    *Index
+	p        *profile.Profile
+	report   *reportCollector
+	progress *progressTracker
+
+	// symbolByFunc maps the profile functions to their interned info.
+	symbolByFunc map[*profile.Function]*funcSymbol
+
+	// funcs are the unique function keys sorted in the index order.
+	// A func ID is an index inside this slice.
+	funcs []funcTemplate
+
+	// Group names, sorted. A group ID is an index inside these slices.
+	pkgNames  []string
+	fileNames []string
+	dirNames  []string
+
+	// shards own the aggregated points and call edges.
+	// shardByFunc maps a func ID to its shard index.
+	shards      []*aggregationShard
+	shardByFunc []uint32
+}
+
+// funcSymbol is a parsed profile function info.
+// It's shared between all frames that refer to the same function.
+type funcSymbol struct {
+	name   string
+	funcID uint32
+
+	// noPackage is set for the functions that can't be indexed.
+	noPackage bool
+
+	// isLeaf reports whether this function belongs to the LeafPackages.
+	isLeaf bool
+}
+
+// funcTemplate describes a unique function key.
+// Several profile functions can share the same key.
+type funcTemplate struct {
+	key          Key
+	origFilename string
+	pkgPath      string
+	pkgID        uint32
+	fileID       uint32
+	dirID        uint32
+}
+
+// aggregationShard owns the data points of a func IDs range
+// and the call edges of the callers from that range.
+// Every unique point is stored in exactly one shard,
+// so the memory usage doesn't grow with the number of workers.
+type aggregationShard struct {
+	mu     sync.Mutex
+	points pointBuffer
+	edges  callEdgeBuffer
+}
+
+// maxPendingRecords is a number of records that a worker collects
+// for a shard before adding them to the shard buffers.
+const maxPendingRecords = 256
+
+// sampleWorker holds the goroutine-local state of the samples walking.
+// The counters are indexed by the interned IDs.
+type sampleWorker struct {
+	report     *reportCollector
+	totalValue int64
+	// totalSamples is a sum of the sample counts.
+	totalSamples int64
+	funcs        []valueCounter
+	pkgs         []valueCounter
+	files        []valueCounter
+	dirs         []valueCounter
+
+	// Per-shard records that are not added to the shard buffers yet.
+	pendingPoints [][]pointRecord
+	pendingEdges  [][]callEdge
+
+	// Reused per-sample stacktrace buffers.
+	syms  []*funcSymbol
+	lines []int64
 }
 
 func (w *profileWalker) Walk() error {
 	// TODO: implement profiles merging?
-	if w.index.funcIDByKey != nil {
-		return errors.New("unimplemented yet: adding several profiles")
+	if w.index.funcs != nil {
+		return ErrIndexNotEmpty
 	}
 
 	// TODO: support other kinds of profiles, like heap allocs?
 	if len(w.p.SampleType) != 2 {
-		return errors.New("unexpected profile type")
+		return fmt.Errorf("%w: expected 2 sample types, found %d", ErrInvalidProfile, len(w.p.SampleType))
 	}
 	switch w.p.SampleType[1].Type + "/" + w.p.SampleType[1].Unit {
 	case "cpu/nanoseconds":
 		// OK.
 	default:
-		return fmt.Errorf("can't handle %s/%s samples yet", w.p.SampleType[1].Type, w.p.SampleType[1].Unit)
+		return &UnsupportedSampleTypeError{Type: w.p.SampleType[1].Type, Unit: w.p.SampleType[1].Unit}
 	}
 
-	pointGreater := func(x, y dataPoint) bool {
-		if x.cumValue > y.cumValue {
-			return true
+	numWorkers := w.index.config.Parallelism
+
+	// Step 1: intern the profile functions.
+	// This way every function name is parsed only once and
+	// the aggregation can use slices instead of maps.
+	w.internFunctions()
+
+	// Step 2: walk the samples.
+	// The samples are processed in batches by several goroutines.
+	// Every sample is handled by exactly one goroutine, so the per-sample
+	// deduplication of the cumulative values works as usual.
+	// The data points are aggregated by the shards that own their func IDs.
+	w.shards = make([]*aggregationShard, numWorkers)
+	w.shardByFunc = make([]uint32, len(w.funcs))
+	for shard := range w.shards {
+		w.shards[shard] = &aggregationShard{}
+		minID := shard * len(w.funcs) / numWorkers
+		maxID := (shard + 1) * len(w.funcs) / numWorkers
+		for funcID := minID; funcID < maxID; funcID++ {
+			w.shardByFunc[funcID] = uint32(shard)
+		}
+	}
+	numSamples := len(w.p.Sample)
+	if err := w.progress.Start(PhaseAggregate, numSamples); err != nil {
+		return err
+	}
+	batchErrors := make([]error, (numSamples+progressStep-1)/progressStep)
+	workers := make([]*sampleWorker, numWorkers)
+	for i := range workers {
+		workers[i] = &sampleWorker{
+			report: newReportCollector(),
+			funcs:  newValueCounters(len(w.funcs)),
+			pkgs:   newValueCounters(len(w.pkgNames)),
+			files:  newValueCounters(len(w.fileNames)),
+			dirs:   newValueCounters(len(w.dirNames)),
+
+			pendingPoints: make([][]pointRecord, len(w.shards)),
+			pendingEdges:  make([][]callEdge, len(w.shards)),
 		}
-		if x.cumValue < y.cumValue {
-			return false
+	}
+	failed := int32(0)
+	parallelFor(numSamples, progressStep, numWorkers, func(worker, from, to int) {
+		if atomic.LoadInt32(&failed) != 0 {
+			return
+		}
+		err := w.walkSamples(workers[worker], from, to)
+		if err == nil {
+			err = w.progress.Step(to - from)
+		}
+		if err != nil {
+			batchErrors[from/progressStep] = err
+			atomic.StoreInt32(&failed, 1)
 		}
-		return x.line > y.line
+	})
+	for _, sw := range workers {
+		w.report.Merge(sw.report)
+	}
+	if err := w.progress.ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range batchErrors {
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.progress.Finish(); err != nil {
+		return err
 	}
 
-	type funcIndexTemplate struct {
-		funcIndex
-		origFilename string
-		key          Key
-		dataByLine   map[int64]dataPoint
+	// Step 3: merge the worker-local data.
+	// The shards own the disjoint func IDs ranges,
+	// so their buffers are compacted in parallel
+	// and then concatenated in the shards order.
+	if err := w.progress.Start(PhaseSort, numWorkers); err != nil {
+		return err
+	}
+	total := workers[0]
+	for _, sw := range workers[1:] {
+		total.totalValue += sw.totalValue
+		total.totalSamples += sw.totalSamples
+		mergeValueCounters(total.funcs, sw.funcs)
+		mergeValueCounters(total.pkgs, sw.pkgs)
+		mergeValueCounters(total.files, sw.files)
+		mergeValueCounters(total.dirs, sw.dirs)
+	}
+	shards := make([][]pointRecord, numWorkers)
+	parallelFor(numWorkers, 1, numWorkers, func(_, shard, _ int) {
+		for _, sw := range workers {
+			w.flushPending(sw, shard)
+		}
+		b := w.shards[shard]
+		b.points.Compact()
+		b.edges.Compact()
+		shards[shard] = b.points.records
+		// The cancellation error is reported below.
+		_ = w.progress.Step(1)
+	})
+	var edges []callEdge
+	for _, b := range w.shards {
+		edges = append(edges, b.edges.edges...)
+	}
+	w.shards = nil
+	if err := w.progress.Finish(); err != nil {
+		return err
 	}
 
-	// Step 1: aggregate the samples, build intermediate mappings.
 	numDataPoints := uint64(0)
-	filenameSet := map[string]uint32{}
-	m := map[Key]*funcIndexTemplate{}
-	var stacktrace []profile.Line
-	for _, s := range w.p.Sample {
-		sampleValue := uint32(s.Value[1] / 1000)
-		if s.Value[1] < 1000 || sampleValue == 0 {
-			return fmt.Errorf("found a sample value that is too small (%d ns)", s.Value[1])
-		}
-		stacktrace = stacktrace[:0]
-		for _, loc := range s.Location {
-			stacktrace = append(stacktrace, loc.Line...)
-		}
-		for i, l := range stacktrace {
-			// The first record in the stacktrace is the current function,
-			// so we count this sample as self value (goes to a "flat" score).
-			isSelf := i == 0
-			sym := pprofutil.ParseFuncName(l.Function.Name)
-			if sym.PkgName == "" {
-				continue
-			}
-			lineNum := l.Line
-			if lineNum > math.MaxUint32 {
-				continue
-			}
-			origFilename := l.Function.Filename
-			filenameSet[origFilename] = 0 // Will be set to an actual index later
-			key := Key{
-				TypeName: sym.TypeName,
-				FuncName: sym.FuncName,
-				PkgName:  sym.PkgName,
-				Filename: filepath.Base(origFilename),
-			}
-			fn := m[key]
-			if fn == nil {
-				fn = &funcIndexTemplate{
-					funcIndex: funcIndex{
-						minLine: math.MaxUint32,
-					},
-					key:          key,
-					origFilename: origFilename,
-					dataByLine:   map[int64]dataPoint{},
-				}
-				m[key] = fn
+	for _, records := range shards {
+		numDataPoints += uint64(len(records))
+	}
+	if numDataPoints == 0 {
+		return ErrNoSamples
+	}
+	if numDataPoints > math.MaxUint32 {
+		return fmt.Errorf("%w (%d)", ErrTooManyDataPoints, numDataPoints)
+	}
+
+	// Step 4: put all points into one slice, bind data ranges to functions.
+	// Only the groups and functions that have some samples are included.
+	pkgStats, pkgIndex := buildGroupStats(w.pkgNames, total.pkgs)
+	fileStats, fileIndex := buildGroupStats(w.fileNames, total.files)
+	dirStats, _ := buildGroupStats(w.dirNames, total.dirs)
+	filenames := make([]string, len(fileStats))
+	for i, g := range fileStats {
+		filenames[i] = g.name
+	}
+	allPoints := make([]dataPoint, 0, numDataPoints)
+	var funcs []funcIndex
+	var keys []Key
+	newFuncIDs := make([]int32, len(w.funcs))
+	for i := range newFuncIDs {
+		newFuncIDs[i] = -1
+	}
+	for _, records := range shards {
+		for len(records) != 0 {
+			funcID := records[0].funcID
+			n := 1
+			for n < len(records) && records[n].funcID == funcID {
+				n++
 			}
-			pt, ok := fn.dataByLine[lineNum]
-			if !ok {
-				numDataPoints++
-				pt.line = uint32(lineNum)
+			tmpl := &w.funcs[funcID]
+			counter := &total.funcs[funcID]
+			fn := funcIndex{
+				minLine:   records[0].pt.line,
+				maxLine:   records[n-1].pt.line,
+				dataFrom:  uint32(len(allPoints)),
+				fileID:    uint32(fileIndex[tmpl.fileID]),
+				pkgID:     uint32(pkgIndex[tmpl.pkgID]),
+				flatValue: counter.flatValue,
+				cumValue:  counter.cumValue,
 			}
-			pt.cumValue += durationValue(sampleValue)
-			if isSelf {
-				pt.flatValue += durationValue(sampleValue)
+			for _, r := range records[:n] {
+				allPoints = append(allPoints, r.pt)
 			}
-			fn.dataByLine[lineNum] = pt
+			fn.dataTo = uint32(len(allPoints))
+			newFuncIDs[funcID] = int32(len(funcs))
+			keys = append(keys, tmpl.key)
+			funcs = append(funcs, fn)
+			records = records[n:]
 		}
 	}
 
-	if numDataPoints == 0 {
-		return errors.New("found no suitable samples")
+	samplingPeriod := int64(0)
+	if pt := w.p.PeriodType; pt != nil && pt.Type == "cpu" && pt.Unit == "nanoseconds" {
+		samplingPeriod = w.p.Period
 	}
-	if numDataPoints > math.MaxUint32 {
-		return fmt.Errorf("too many samples (%d)", numDataPoints)
+	// The heat levels computation can be cancelled too,
+	// so the data goes to a separate index until it's complete.
+	index := &Index{config: w.index.config}
+	index.valuePeriod = computeValuePeriod(total.totalValue, total.totalSamples, samplingPeriod)
+	index.metadata = w.collectMetadata()
+	index.totalValue = total.totalValue
+	index.filenames = filenames
+	index.pkgStats = pkgStats
+	index.dirStats = dirStats
+	index.fileStats = fileStats
+	index.funcs = funcs
+	index.funcTable = newFuncTable(keys)
+	index.dataPoints = allPoints
+	index.callEdges = remapCallEdges(edges[:0], edges, newFuncIDs)
+	index.callerOrder = buildCallerOrder(index.callEdges, len(funcs))
+
+	if stacksPerLine := index.config.StacksPerLine; stacksPerLine != 0 {
+		w.collectStacks().Build(index, newFuncIDs, stacksPerLine)
 	}
 
-	// Step 2: sort all filenames.
-	sortedFilenames := make([]string, 0, len(filenameSet))
-	for filename := range filenameSet {
-		sortedFilenames = append(sortedFilenames, filename)
+	w.report.report.NumFuncs = len(index.funcs)
+	w.report.report.NumLines = len(index.dataPoints)
+
+	// Step 5: compute the heat levels.
+	if err := computeLevels(index, w.progress); err != nil {
+		return err
 	}
-	sort.Strings(sortedFilenames)
-	for i, filename := range sortedFilenames {
-		filenameSet[filename] = uint32(i)
+
+	*w.index = *index
+	return nil
+}
+
+// internFunctions assigns the IDs to all profile functions and groups.
+// IDs follow the index order, so the data sorted by ID needs no reordering.
+//
+// If several functions have the same key, the first one defines
+// the key filename and package.
+func (w *profileWalker) internFunctions() {
+	functions := w.profileFunctions()
+	symbols := make([]funcSymbol, len(functions))
+	w.symbolByFunc = make(map[*profile.Function]*funcSymbol, len(functions))
+	funcIDs := make(map[Key]uint32, len(functions))
+	for i, f := range functions {
+		sym := &symbols[i]
+		sym.name = f.Name
+		w.symbolByFunc[f] = sym
+		parsed := pprofutil.ParseFuncName(f.Name)
+		if parsed.PkgName == "" {
+			sym.noPackage = true
+			continue
+		}
+		sym.isLeaf = matchPkgPath(w.index.config.LeafPackages, parsed.PkgPath)
+		key := Key{
+			TypeName: parsed.TypeName,
+			FuncName: parsed.FuncName,
+			PkgName:  parsed.PkgName,
+			Filename: filepath.Base(f.Filename),
+		}
+		funcID, ok := funcIDs[key]
+		if !ok {
+			funcID = uint32(len(w.funcs))
+			funcIDs[key] = funcID
+			w.funcs = append(w.funcs, funcTemplate{
+				key:          key,
+				origFilename: f.Filename,
+				pkgPath:      parsed.PkgPath,
+			})
+		}
+		sym.funcID = funcID
 	}
 
-	// Step 3: sort all functions.
-	funcs := make([]*funcIndexTemplate, 0, len(m))
-	for _, fn := range m {
-		fn.fileID = filenameSet[fn.origFilename]
-		funcs = append(funcs, fn)
+	funcOrder := make([]uint32, len(w.funcs))
+	for i := range funcOrder {
+		funcOrder[i] = uint32(i)
 	}
-	sort.Slice(funcs, func(i, j int) bool {
-		f1 := funcs[i]
-		f2 := funcs[j]
+	sort.Slice(funcOrder, func(i, j int) bool {
+		f1 := &w.funcs[funcOrder[i]]
+		f2 := &w.funcs[funcOrder[j]]
 		if f1.origFilename != f2.origFilename {
 			return f1.origFilename < f2.origFilename
 		}
 		if f1.key.TypeName != f2.key.TypeName {
 			return f1.key.TypeName < f2.key.TypeName
 		}
-		return f1.key.FuncName < f2.key.FuncName
+		if f1.key.FuncName != f2.key.FuncName {
+			return f1.key.FuncName < f2.key.FuncName
+		}
+		return f1.key.PkgName < f2.key.PkgName
 	})
+	newFuncIDs := make([]uint32, len(w.funcs))
+	sortedFuncs := make([]funcTemplate, len(w.funcs))
+	for newID, oldID := range funcOrder {
+		newFuncIDs[oldID] = uint32(newID)
+		sortedFuncs[newID] = w.funcs[oldID]
+	}
+	w.funcs = sortedFuncs
+	for i := range symbols {
+		sym := &symbols[i]
+		if !sym.noPackage {
+			sym.funcID = newFuncIDs[sym.funcID]
+		}
+	}
 
-	// Step 4: put all aggregated points into one slice, bind data ranges to files.
-	allPoints := make([]dataPoint, 0, numDataPoints)
-	for _, fn := range funcs {
-		fn.dataFrom = uint32(len(allPoints))
-		for _, pt := range fn.dataByLine {
-			allPoints = append(allPoints, pt)
-			if pt.line > fn.maxLine {
-				fn.maxLine = pt.line
+	pkgIDs := map[string]uint32{}
+	fileIDs := map[string]uint32{}
+	dirIDs := map[string]uint32{}
+	for _, fn := range w.funcs {
+		pkgIDs[fn.pkgPath] = 0
+		fileIDs[fn.origFilename] = 0
+		dirIDs[filepath.Dir(fn.origFilename)] = 0
+	}
+	w.pkgNames = sortedNames(pkgIDs)
+	w.fileNames = sortedNames(fileIDs)
+	w.dirNames = sortedNames(dirIDs)
+	for i := range w.funcs {
+		fn := &w.funcs[i]
+		fn.pkgID = pkgIDs[fn.pkgPath]
+		fn.fileID = fileIDs[fn.origFilename]
+		fn.dirID = dirIDs[filepath.Dir(fn.origFilename)]
+	}
+}
+
+// profileFunctions returns the profile functions table extended with
+// the functions that are referenced only by the sample locations.
+// The parsed profiles have a complete table, but the ones that
+// are built in code may have it incomplete or even empty.
+func (w *profileWalker) profileFunctions() []*profile.Function {
+	// Copy the table, so the appends below don't modify the profile.
+	functions := append([]*profile.Function(nil), w.p.Function...)
+	known := make(map[*profile.Function]struct{}, len(functions))
+	for _, f := range functions {
+		known[f] = struct{}{}
+	}
+	for _, s := range w.p.Sample {
+		for _, loc := range s.Location {
+			for _, l := range loc.Line {
+				if _, ok := known[l.Function]; ok {
+					continue
+				}
+				known[l.Function] = struct{}{}
+				functions = append(functions, l.Function)
 			}
-			if pt.line < fn.minLine {
-				fn.minLine = pt.line
+		}
+	}
+	return functions
+}
+
+// walkSamples handles the [from, to) samples range.
+func (w *profileWalker) walkSamples(sw *sampleWorker, from, to int) error {
+	for sampleID := from; sampleID < to; sampleID++ {
+		s := w.p.Sample[sampleID]
+		if s.Value[1] < 0 {
+			return &SampleValueError{Value: s.Value[1]}
+		}
+		sw.totalValue += s.Value[1]
+		sw.totalSamples += s.Value[0]
+		sw.report.report.NumSamples++
+		if s.Value[1] < 1000 {
+			// The values are stored in microseconds.
+			sw.report.report.DroppedSamples.Add(DropSmallValue)
+			continue
+		}
+		sampleValue := uint32(s.Value[1] / 1000)
+		syms := sw.syms[:0]
+		lines := sw.lines[:0]
+		for _, loc := range s.Location {
+			if len(loc.Line) == 0 {
+				sw.report.report.NumFrames++
+				sw.report.AddDroppedFrame(DropUnsymbolized, unsymbolizedName(loc), s.Value[1])
+				continue
 			}
+			for _, l := range loc.Line {
+				sym := w.symbolByFunc[l.Function]
+				syms = append(syms, sym)
+				lines = append(lines, l.Line)
+			}
+		}
+		sw.syms = syms
+		sw.lines = lines
+		sw.report.report.NumFrames += len(syms)
+		sampleIndexed := false
+		lineDropped := false
+		sampleDropReason := DropUnsymbolized
+		// The first record in the stacktrace is the current function,
+		// so we count this sample as self value (goes to a "flat" score).
+		// In the attribution mode, the leaf packages frames
+		// pass their self value to the first caller from other packages.
+		selfIndex := 0
+		if len(w.index.config.LeafPackages) != 0 {
+			selfIndex = findSelfIndex(syms)
 		}
-		fn.dataTo = uint32(len(allPoints))
-
-		// Compute local heat levels.
-		funcData := allPoints[fn.dataFrom:fn.dataTo]
-		sort.Slice(funcData, func(i, j int) bool {
-			return pointGreater(funcData[i], funcData[j])
-		})
-		topn := int(float64(len(funcData)) * w.index.config.Threshold)
-		if topn == 0 {
-			topn = 1
-		}
-		points := funcData[:topn]
-		currentLevel := 5
-		currentChunk := 0
-		forChunks(len(points), maxHeatLevel, func(chunkNum, i int) {
-			pt := &points[i]
-			if currentChunk != chunkNum {
-				currentLevel--
-				currentChunk = chunkNum
+		for i, sym := range syms {
+			isSelf := i == selfIndex
+			if reason, dropped := lineDropReason(sym, lines[i]); dropped {
+				sw.report.AddDroppedFrame(reason, sym.name, s.Value[1])
+				if !lineDropped {
+					lineDropped = true
+					sampleDropReason = reason
+				}
+				continue
 			}
-			pt.flags.SetLocalLevel(currentLevel)
-		})
-		// A final sort: by line.
-		sort.Slice(funcData, func(i, j int) bool {
-			return funcData[i].line < funcData[j].line
-		})
-	}
-
-	// Step 5: compute the global heat levels.
-	valueOrder := make([]uint32, len(allPoints))
-	for i := range allPoints {
-		valueOrder[i] = uint32(i)
-	}
-	sort.Slice(valueOrder, func(i, j int) bool {
-		x := allPoints[valueOrder[i]]
-		y := allPoints[valueOrder[j]]
-		return pointGreater(x, y)
-	})
-	{
-		topn := int(float64(numDataPoints) * w.index.config.Threshold)
-		if topn == 0 {
-			topn = 1
-		}
-		currentLevel := 5
-		currentChunk := 0
-		forChunks(topn, maxHeatLevel, func(chunkNum, i int) {
-			pt := &allPoints[valueOrder[i]]
-			if currentChunk != chunkNum {
-				currentLevel--
-				currentChunk = chunkNum
+			sampleIndexed = true
+			// A recursive call can repeat the same line several times,
+			// but the sample should be counted only once for it,
+			// like pprof does for the cum values.
+			// Only the functions that were already seen in this sample
+			// can have such repeated frames.
+			funcSeen := sw.funcs[sym.funcID].lastSample == sampleID
+			repeated := funcSeen && isRepeatedFrame(syms, lines, i)
+			// Recursive calls should not inflate the cum values,
+			// so the counters count every sample only once.
+			fn := &w.funcs[sym.funcID]
+			sw.funcs[sym.funcID].AddSample(sampleID, s.Value[1], isSelf)
+			sw.pkgs[fn.pkgID].AddSample(sampleID, s.Value[1], isSelf)
+			sw.files[fn.fileID].AddSample(sampleID, s.Value[1], isSelf)
+			sw.dirs[fn.dirID].AddSample(sampleID, s.Value[1], isSelf)
+			pt := dataPoint{line: uint32(lines[i])}
+			if !repeated {
+				pt.numSamples = sampleCount(0).Add(s.Value[0])
+				pt.cumValue = durationValue(sampleValue)
 			}
-			pt.flags.SetGlobalLevel(currentLevel)
-		})
-	}
-
-	w.index.filenames = sortedFilenames
-	w.index.funcs = make([]funcIndex, len(funcs))
-	w.index.funcIDByKey = map[Key]uint32{}
-	w.index.dataPoints = allPoints
-	for i, fn := range funcs {
-		funcData := allPoints[fn.dataFrom:fn.dataTo]
-		for i := range funcData {
-			pt := &funcData[i]
-			if pt.flags.GetLocalLevel() > int(fn.maxLocalLevel) {
-				fn.maxLocalLevel = uint8(pt.flags.GetLocalLevel())
+			if isSelf {
+				pt.flatValue = durationValue(sampleValue)
 			}
-			if pt.flags.GetGlobalLevel() > int(fn.maxGlobalLevel) {
-				fn.maxGlobalLevel = uint8(pt.flags.GetGlobalLevel())
+			w.addPoint(sw, sym.funcID, pt)
+			// The next frame is a caller of this one.
+			if w.index.config.CallGraph && i+1 < len(syms) {
+				if _, dropped := lineDropReason(syms[i+1], lines[i+1]); !dropped {
+					e := callEdge{
+						callerID: syms[i+1].funcID,
+						line:     uint32(lines[i+1]),
+						calleeID: sym.funcID,
+					}
+					// Recursive calls count every sample only once.
+					if !funcSeen || !isRepeatedCall(syms, lines, i) {
+						e.value = durationValue(sampleValue)
+						e.numSamples = sampleCount(0).Add(s.Value[0])
+					}
+					w.addEdge(sw, e)
+				}
 			}
 		}
-		w.index.funcs[i] = fn.funcIndex
-		w.index.funcIDByKey[fn.key] = uint32(i)
+		if !sampleIndexed {
+			sw.report.report.DroppedSamples.Add(sampleDropReason)
+		}
 	}
-
 	return nil
 }
+
+// addPoint adds the data point to the worker pending records.
+// If there is only one worker, the point goes to the shard directly.
+func (w *profileWalker) addPoint(sw *sampleWorker, funcID uint32, pt dataPoint) {
+	if len(w.shards) == 1 {
+		w.shards[0].points.Add(funcID, pt)
+		return
+	}
+	shard := w.shardByFunc[funcID]
+	sw.pendingPoints[shard] = append(sw.pendingPoints[shard], pointRecord{funcID: funcID, pt: pt})
+	if len(sw.pendingPoints[shard]) == maxPendingRecords {
+		w.flushPending(sw, int(shard))
+	}
+}
+
+// addEdge is like addPoint, but for the call edges.
+// The edges belong to the shard of their caller.
+func (w *profileWalker) addEdge(sw *sampleWorker, e callEdge) {
+	if len(w.shards) == 1 {
+		w.shards[0].edges.Add(e)
+		return
+	}
+	shard := w.shardByFunc[e.callerID]
+	sw.pendingEdges[shard] = append(sw.pendingEdges[shard], e)
+	if len(sw.pendingEdges[shard]) == maxPendingRecords {
+		w.flushPending(sw, int(shard))
+	}
+}
+
+// flushPending adds the worker pending records to the shard buffers.
+func (w *profileWalker) flushPending(sw *sampleWorker, shard int) {
+	b := w.shards[shard]
+	b.mu.Lock()
+	for _, r := range sw.pendingPoints[shard] {
+		b.points.Add(r.funcID, r.pt)
+	}
+	for _, e := range sw.pendingEdges[shard] {
+		b.edges.Add(e)
+	}
+	b.mu.Unlock()
+	sw.pendingPoints[shard] = sw.pendingPoints[shard][:0]
+	sw.pendingEdges[shard] = sw.pendingEdges[shard][:0]
+}
+
+// collectStacks builds a prefix tree of all sample stack traces.
+// It's done sequentially, so the tree node IDs are deterministic.
+//
+// The samples are expected to be validated by the walkSamples.
+func (w *profileWalker) collectStacks() *stackTreeBuilder {
+	b := newStackTreeBuilder()
+	var frames []stackNode
+	for _, s := range w.p.Sample {
+		if s.Value[1] < 1000 {
+			continue // Dropped as DropSmallValue
+		}
+		frames = frames[:0]
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			loc := s.Location[i]
+			for j := len(loc.Line) - 1; j >= 0; j-- {
+				l := loc.Line[j]
+				sym := w.symbolByFunc[l.Function]
+				if _, dropped := lineDropReason(sym, l.Line); dropped {
+					continue
+				}
+				frames = append(frames, stackNode{funcID: sym.funcID, line: uint32(l.Line)})
+			}
+		}
+		b.AddStack(frames, durationValue(s.Value[1]/1000), s.Value[0])
+	}
+	return b
+}
+
+// sortedNames returns the sorted map keys.
+// Map values are set to the key positions inside the result slice.
+func sortedNames(m map[string]uint32) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		m[name] = uint32(i)
+	}
+	return names
+}
+
+// lineDropReason reports whether the stacktrace line should be skipped.
+func lineDropReason(sym *funcSymbol, line int64) (DropReason, bool) {
+	if sym.noPackage {
+		return DropNoPackage, true
+	}
+	if line > math.MaxUint32 {
+		return DropLineOverflow, true
+	}
+	return 0, false
+}
+
+// isRepeatedFrame reports whether any of the frames before i
+// has the same function and line as the frame i.
+func isRepeatedFrame(syms []*funcSymbol, lines []int64, i int) bool {
+	for j := 0; j < i; j++ {
+		if isSameFrame(syms, lines, j, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRepeatedCall is like isRepeatedFrame, but it checks the call
+// from the frame i+1 line to the frame i function.
+func isRepeatedCall(syms []*funcSymbol, lines []int64, i int) bool {
+	for j := 0; j < i; j++ {
+		if !syms[j].noPackage && syms[j].funcID == syms[i].funcID && isSameFrame(syms, lines, j+1, i+1) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSameFrame(syms []*funcSymbol, lines []int64, i, j int) bool {
+	return !syms[i].noPackage && syms[i].funcID == syms[j].funcID && lines[i] == lines[j]
+}
+
+// findSelfIndex returns the index of the first stacktrace frame that
+// doesn't belong to the leaf packages.
+// If there is no such frame, 0 is returned.
+func findSelfIndex(syms []*funcSymbol) int {
+	for i, sym := range syms {
+		if sym.noPackage {
+			continue
+		}
+		if !sym.isLeaf {
+			return i
+		}
+	}
+	return 0
+}
+
+func (w *profileWalker) collectMetadata() Metadata {
+	metadata := Metadata{
+		SampleType: w.p.SampleType[1].Type,
+		SampleUnit: w.p.SampleType[1].Unit,
+		Period:     w.p.Period,
+		Duration:   time.Duration(w.p.DurationNanos),
+		Comments:   append([]string(nil), w.p.Comments...),
+	}
+	if w.p.PeriodType != nil {
+		metadata.PeriodType = w.p.PeriodType.Type
+		metadata.PeriodUnit = w.p.PeriodType.Unit
+	}
+	if w.p.TimeNanos != 0 {
+		metadata.TimeCollected = time.Unix(0, w.p.TimeNanos)
+	}
+	// By convention, the first mapping is the main binary.
+	if len(w.p.Mapping) != 0 {
+		metadata.MainBinary = w.p.Mapping[0].File
+		metadata.BuildID = w.p.Mapping[0].BuildID
+	}
+	return metadata
+}
@@ -2,8 +2,11 @@ package heatmap
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -60,10 +63,8 @@ func TestConvertTestKey(t *testing.T) {
 func TestAddProfile(t *testing.T) {
 	dumpIndex := func(index *Index) []string {
 		var lines []string
-		sortedKeys := make([]Key, 0, len(index.funcIDByKey))
-		for key := range index.funcIDByKey {
-			sortedKeys = append(sortedKeys, key)
-		}
+		sortedKeys := make([]Key, 0, index.funcTable.Len())
+		sortedKeys = append(sortedKeys, index.funcTable.keys...)
 		sort.Slice(sortedKeys, func(i, j int) bool {
 			x := sortedKeys[i]
 			y := sortedKeys[j]
@@ -79,7 +80,7 @@ func TestAddProfile(t *testing.T) {
 			return x.FuncName < y.FuncName
 		})
 		for _, key := range sortedKeys {
-			funcID := index.funcIDByKey[key]
+			funcID, _ := index.funcTable.Lookup(key)
 			fn := &index.funcs[funcID]
 			lines = append(lines, fmt.Sprintf("func %s (L=%d G=%d)",
 				formatFuncName(key.PkgName, key.TypeName, key.FuncName), fn.maxLocalLevel, fn.maxGlobalLevel))
@@ -722,7 +723,12 @@ func TestAddProfile(t *testing.T) {
 		},
 	}
 
-	ignoreFields := cmpopts.IgnoreFields(LineStats{}, "Value", "FlatValue", "LineNum")
+	// Flat values depend on the randomized stack order, so
+	// flat levels are checked separately.
+	ignoreFields := cmpopts.IgnoreFields(LineStats{}, "Value", "FlatValue", "LineNum",
+		"NumSamples", "Confidence", "ValueLow", "ValueHigh",
+		"LocalRank", "GlobalRank", "ShareOfTotal",
+		"FlatHeatLevel", "FlatGlobalHeatLevel")
 	statsDiff := func(x, y interface{}) string {
 		return cmp.Diff(x, y, ignoreFields)
 	}
@@ -736,7 +742,7 @@ func TestAddProfile(t *testing.T) {
 			return x.HeatLevel == y.HeatLevel && x.GlobalHeatLevel == y.GlobalHeatLevel
 		}
 
-		for key, funcID := range index.funcIDByKey {
+		for funcID, key := range index.funcTable.keys {
 			fn := index.funcs[funcID]
 			filename := index.filenames[fn.fileID]
 			data := index.dataPoints[fn.dataFrom:fn.dataTo]
@@ -802,6 +808,19 @@ func TestAddProfile(t *testing.T) {
 			if diff := statsDiff(have, want); diff != "" {
 				t.Errorf("results mismatch:\n(+want -have)\n%s", diff)
 			}
+			otherIndex := NewIndex(IndexConfig{Threshold: 0.1, MinConfidence: 0.5})
+			if err := otherIndex.AddProfile(p); err != nil {
+				t.Fatal(err)
+			}
+			otherIndexDump := dumpIndex(otherIndex)
+			relevelled := otherIndex.Relevel(test.config)
+			if diff := cmp.Diff(dumpIndex(otherIndex), otherIndexDump); diff != "" {
+				t.Errorf("relevel modified the original index:\n(+want -have)\n%s", diff)
+			}
+			validateIndex(t, relevelled)
+			if diff := cmp.Diff(dumpIndex(relevelled), have); diff != "" {
+				t.Errorf("relevel results mismatch:\n(+want -have)\n%s", diff)
+			}
 			for _, q := range test.queries {
 				have := index.QueryLine(convertTestKey(q.key), q.line)
 				want := q.want
@@ -834,11 +853,657 @@ func TestAddProfile(t *testing.T) {
 	}
 }
 
+func TestSampleCounts(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("a.go:pkg.f",
+			10000, []int{1, 2},
+			20000, []int{2},
+			30000, []int{2, 3},
+			40000, []int{2, 4, 2}). // A recursive call.
+		Build()
+	p.Sample[0].Value[0] = 3 // A merged sample.
+
+	index := NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTotal := 3 + 1 + 1 + 1
+	haveTotal := 0
+	index.Inspect(func(s LineStats) {
+		if s.LineNum == 2 {
+			haveTotal = s.NumSamples
+		}
+	})
+	if haveTotal != wantTotal {
+		t.Fatalf("line 2 samples number mismatch: have %d, want %d", haveTotal, wantTotal)
+	}
+
+	n := sampleCount(0)
+	n = n.Add(math.MaxUint16 - 1)
+	n = n.Add(10)
+	if n != math.MaxUint16 {
+		t.Fatalf("sample counter is expected to saturate, got %d", n)
+	}
+}
+
+func TestMinConfidence(t *testing.T) {
+	// The second profile doesn't record the real samples count,
+	// so the samples number is derived from the values and the period.
+	for _, realCounts := range []bool{true, false} {
+		p := newTestProfileBuilder().
+			AddSamples("a.go:pkg.f",
+				400000, []int{1},
+				4000, []int{2}).
+			Build()
+		for _, s := range p.Sample {
+			s.Value[0] = 1
+			if realCounts {
+				s.Value[0] = s.Value[1] / 1000
+			}
+		}
+		p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+		p.Period = 1000
+
+		index := NewIndex(IndexConfig{Threshold: 1, MinConfidence: 0.5})
+		if err := index.AddProfile(p); err != nil {
+			t.Fatal(err)
+		}
+
+		key := convertTestKey("a.go:pkg.f")
+		line1 := index.QueryLine(key, 1)
+		line2 := index.QueryLine(key, 2)
+		if line1.HeatLevel != 5 || line1.GlobalHeatLevel != 5 {
+			t.Fatalf("realCounts=%v: line 1 is expected to be hot: %#v", realCounts, line1)
+		}
+		if line2.HeatLevel != 0 || line2.GlobalHeatLevel != 0 {
+			t.Fatalf("realCounts=%v: line 2 is expected to be demoted: %#v", realCounts, line2)
+		}
+		approxEqual := func(x, y float64) bool {
+			return math.Abs(x-y) < 0.0001
+		}
+		if !approxEqual(line1.Confidence, 0.902) || !approxEqual(line2.Confidence, 0.02) {
+			t.Fatalf("realCounts=%v: confidence mismatch: %f and %f", realCounts, line1.Confidence, line2.Confidence)
+		}
+		if line1.ValueLow != 360800 || line1.ValueHigh != 439200 {
+			t.Fatalf("realCounts=%v: line 1 value interval mismatch: [%d, %d]", realCounts, line1.ValueLow, line1.ValueHigh)
+		}
+		if line2.ValueLow != 80 || line2.ValueHigh != 7920 {
+			t.Fatalf("realCounts=%v: line 2 value interval mismatch: [%d, %d]", realCounts, line2.ValueLow, line2.ValueHigh)
+		}
+	}
+}
+
+func TestRanks(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("a.go:pkg.f",
+			10000, []int{1},
+			20000, []int{2},
+			20000, []int{3},
+			50000, []int{4}).
+		AddSamples("b.go:pkg.g",
+			100000, []int{1}).
+		Build()
+
+	index := NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key          string
+		line         int
+		localRank    float64
+		globalRank   float64
+		shareOfTotal float64
+	}{
+		{"a.go:pkg.f", 1, 0.25, 0.2, 0.05},
+		{"a.go:pkg.f", 2, 0.75, 0.6, 0.1},
+		{"a.go:pkg.f", 3, 0.75, 0.6, 0.1},
+		{"a.go:pkg.f", 4, 1, 0.8, 0.25},
+		{"b.go:pkg.g", 1, 1, 1, 0.5},
+	}
+
+	for _, test := range tests {
+		have := index.QueryLine(convertTestKey(test.key), test.line)
+		if have.LocalRank != test.localRank || have.GlobalRank != test.globalRank || have.ShareOfTotal != test.shareOfTotal {
+			t.Errorf("QueryLine(%q, %d): have ranks %v/%v/%v, want %v/%v/%v",
+				test.key, test.line,
+				have.LocalRank, have.GlobalRank, have.ShareOfTotal,
+				test.localRank, test.globalRank, test.shareOfTotal)
+		}
+	}
+
+	// Recursive calls don't make the line value bigger than the sample value.
+	p = newTestProfileBuilder().
+		AddStack(10000, "a.go:pkg.f:2", "a.go:pkg.f:2", "a.go:pkg.f:2", "main.go:main.main:1").
+		Build()
+	index = NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	have := index.QueryLine(convertTestKey("a.go:pkg.f"), 2)
+	if have.Value != 10000 || have.ShareOfTotal != 1 || have.LocalRank != 1 || have.GlobalRank != 1 {
+		t.Errorf("QueryLine(a.go:pkg.f, 2): have value %d and ranks %v/%v/%v, want 10000 and 1/1/1",
+			have.Value, have.LocalRank, have.GlobalRank, have.ShareOfTotal)
+	}
+}
+
+func TestLocalRanks(t *testing.T) {
+	p := newRandomTestProfile(5, 2000)
+	index := NewIndex(IndexConfig{Threshold: 0.2})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	pruned := NewIndex(IndexConfig{Threshold: 0.2, PruneCold: true})
+	if err := pruned.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	filtered := index.Filter(func(info FuncInfo) bool {
+		return info.PkgName == "pkg1"
+	})
+
+	indexes := []*Index{index, pruned, filtered, index.Relevel(IndexConfig{Threshold: 0.5})}
+	for i, index := range indexes {
+		for funcID, key := range index.funcTable.keys {
+			fn := &index.funcs[funcID]
+			data := index.dataPoints[fn.dataFrom:fn.dataTo]
+			for _, pt := range data {
+				// Compute the rank in the most straightforward way.
+				numGreater := 0
+				for _, other := range data {
+					if other.cumValue > pt.cumValue {
+						numGreater++
+					}
+				}
+				want := float64(len(data)-numGreater) / float64(len(data))
+				have := index.QueryLine(key, int(pt.line)).LocalRank
+				if have != want {
+					t.Fatalf("index%d: %v line %d: have local rank %v, want %v",
+						i, key, pt.line, have, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGlobalPackages(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("a.go:main.f",
+			10000, []int{1},
+			20000, []int{2}).
+		AddSamples("malloc.go:runtime.mallocgc",
+			100000, []int{5}).
+		Build()
+
+	index := NewIndex(IndexConfig{Threshold: 1, GlobalPackages: []string{"main"}})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key        string
+		line       int
+		local      int
+		global     int
+		globalRank float64
+	}{
+		{"a.go:main.f", 1, 4, 4, 0.5},
+		{"a.go:main.f", 2, 5, 5, 1},
+		{"malloc.go:runtime.mallocgc", 5, 5, 0, 0},
+	}
+
+	for _, test := range tests {
+		have := index.QueryLine(convertTestKey(test.key), test.line)
+		if have.HeatLevel != test.local || have.GlobalHeatLevel != test.global || have.GlobalRank != test.globalRank {
+			t.Errorf("QueryLine(%q, %d): have L=%d G=%d rank=%v, want L=%d G=%d rank=%v",
+				test.key, test.line, have.HeatLevel, have.GlobalHeatLevel, have.GlobalRank,
+				test.local, test.global, test.globalRank)
+		}
+	}
+
+	// The main package path is "main", not the module path.
+	p = newTestProfileBuilder().
+		AddSamples("a.go:main.f",
+			10000, []int{1}).
+		AddSamples("b.go:foo.g",
+			20000, []int{3}).
+		AddSamples("malloc.go:runtime.mallocgc",
+			100000, []int{5}).
+		Build()
+	// The test builder doesn't keep the package paths.
+	for _, s := range p.Sample {
+		f := s.Location[0].Line[0].Function
+		if f.Name == "foo.g" {
+			f.Name = "example.com/app/foo.g"
+		}
+	}
+	for _, globalPackages := range [][]string{{"example.com/app"}, {"example.com/app", "main"}} {
+		index := NewIndex(IndexConfig{Threshold: 1, GlobalPackages: globalPackages})
+		if err := index.AddProfile(p); err != nil {
+			t.Fatal(err)
+		}
+		mainGlobal := index.QueryLine(convertTestKey("a.go:main.f"), 1).GlobalHeatLevel
+		fooGlobal := index.QueryLine(convertTestKey("b.go:foo.g"), 3).GlobalHeatLevel
+		wantMainGlobal := len(globalPackages) == 2
+		if (mainGlobal != 0) != wantMainGlobal || fooGlobal != 5 {
+			t.Errorf("GlobalPackages=%v: have main.f G=%d foo.g G=%d", globalPackages, mainGlobal, fooGlobal)
+		}
+	}
+}
+
+func TestMatchPkgPath(t *testing.T) {
+	tests := []struct {
+		prefixes []string
+		pkgPath  string
+		want     bool
+	}{
+		{[]string{"runtime"}, "runtime", true},
+		{[]string{"runtime"}, "runtime/pprof", true},
+		{[]string{"runtime"}, "runtimex", false},
+		{[]string{"internal"}, "internal/abi", true},
+		{[]string{"example.com/foo"}, "example.com/foo/bar", true},
+		{[]string{"example.com/foo"}, "example.com/foobar", false},
+		{[]string{"reflect", "example.com/foo"}, "example.com/foo", true},
+		{[]string{}, "main", false},
+	}
+
+	for _, test := range tests {
+		have := matchPkgPath(test.prefixes, test.pkgPath)
+		if have != test.want {
+			t.Errorf("matchPkgPath(%q, %q): have %v, want %v", test.prefixes, test.pkgPath, have, test.want)
+		}
+	}
+}
+
+func TestLeafPackages(t *testing.T) {
+	buildProfile := newTestProfileBuilder().
+		AddStack(50000, "malloc.go:runtime.mallocgc:10", "slice.go:runtime.growslice:20", "a.go:main.f:5").
+		AddStack(20000, "a.go:main.f:6").
+		AddStack(30000, "malloc.go:runtime.mallocgc:10").
+		Build
+
+	tests := []struct {
+		leafPackages []string
+		key          string
+		line         int
+		flatValue    int64
+	}{
+		{nil, "a.go:main.f", 5, 0},
+		{nil, "a.go:main.f", 6, 20000},
+		{nil, "malloc.go:runtime.mallocgc", 10, 80000},
+
+		// The mallocgc cost that was caused by main.f line 5 goes to that line.
+		// Samples without non-runtime callers are unaffected.
+		{[]string{"runtime"}, "a.go:main.f", 5, 50000},
+		{[]string{"runtime"}, "a.go:main.f", 6, 20000},
+		{[]string{"runtime"}, "malloc.go:runtime.mallocgc", 10, 30000},
+		{[]string{"runtime"}, "slice.go:runtime.growslice", 20, 0},
+	}
+
+	for _, test := range tests {
+		index := NewIndex(IndexConfig{LeafPackages: test.leafPackages})
+		if err := index.AddProfile(buildProfile()); err != nil {
+			t.Fatal(err)
+		}
+		have := index.QueryLine(convertTestKey(test.key), test.line)
+		if have.FlatValue != test.flatValue {
+			t.Errorf("leaf=%q QueryLine(%q, %d): have flat %d, want %d",
+				test.leafPackages, test.key, test.line, have.FlatValue, test.flatValue)
+		}
+	}
+}
+
+func TestThresholdOverrides(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("/proj/util/a.go:util.f",
+			10000, []int{1},
+			20000, []int{2},
+			30000, []int{3},
+			40000, []int{4}).
+		AddSamples("/proj/hot/b.go:hot.g",
+			10000, []int{1},
+			20000, []int{2},
+			30000, []int{3},
+			40000, []int{4}).
+		AddSamples("/proj/c.go:other.h",
+			10000, []int{1},
+			20000, []int{2},
+			30000, []int{3},
+			40000, []int{4}).
+		Build()
+
+	index := NewIndex(IndexConfig{
+		Threshold: 0.5,
+		ThresholdOverrides: []ThresholdOverride{
+			{PkgPath: "util", Threshold: 1},
+			{FilePrefix: "/pr", Threshold: 0.75},
+			{FilePrefix: "/proj/hot/", Threshold: 0.25},
+		},
+	})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     string
+		numHot  int
+		comment string
+	}{
+		{"a.go:util.f", 4, "util is longer than /pr"},
+		{"b.go:hot.g", 1, "/proj/hot/ is the longest match"},
+		{"c.go:other.h", 3, "only /pr matches"},
+	}
+
+	for _, test := range tests {
+		numHot := 0
+		index.QueryLineRange(convertTestKey(test.key), 1, 4, func(s LineStats) bool {
+			if s.HeatLevel != 0 {
+				numHot++
+			}
+			return true
+		})
+		if numHot != test.numHot {
+			t.Errorf("%s: have %d hot lines, want %d (%s)", test.key, numHot, test.numHot, test.comment)
+		}
+	}
+}
+
+func TestMinValue(t *testing.T) {
+	buildProfile := newTestProfileBuilder().
+		Sorted().
+		AddSamples("a.go:pkg.f",
+			10000, []int{1},
+			20000, []int{2, 3},
+			70000, []int{4}).
+		Build
+
+	tests := []struct {
+		config IndexConfig
+		line   int
+		cold   bool
+		flat   bool
+	}{
+		{IndexConfig{Threshold: 1}, 1, false, false},
+		{IndexConfig{Threshold: 1}, 3, false, true},
+
+		{IndexConfig{Threshold: 1, MinShare: 0.15}, 1, true, true},
+		{IndexConfig{Threshold: 1, MinShare: 0.15}, 2, false, false},
+		{IndexConfig{Threshold: 1, MinShare: 0.15}, 3, false, true},
+		{IndexConfig{Threshold: 1, MinShare: 0.15}, 4, false, false},
+
+		{IndexConfig{Threshold: 1, MinValue: 50 * time.Microsecond}, 2, true, true},
+		{IndexConfig{Threshold: 1, MinValue: 50 * time.Microsecond}, 4, false, false},
+
+		{IndexConfig{Threshold: 1, MinValue: 1, MinShare: 0.9}, 4, true, true},
+	}
+
+	for _, test := range tests {
+		index := NewIndex(test.config)
+		if err := index.AddProfile(buildProfile()); err != nil {
+			t.Fatal(err)
+		}
+		s := index.QueryLine(convertTestKey("a.go:pkg.f"), test.line)
+		cold := s.HeatLevel == 0 && s.GlobalHeatLevel == 0
+		flatCold := s.FlatHeatLevel == 0 && s.FlatGlobalHeatLevel == 0
+		if cold != test.cold || flatCold != test.flat {
+			t.Errorf("%+v line %d: have cold=%v flatcold=%v, want %v and %v",
+				test.config, test.line, cold, flatCold, test.cold, test.flat)
+		}
+	}
+}
+
+func TestFuncHeatLevels(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("a.go:pkg.small", 50000, []int{1}).
+		AddSamples("b.go:pkg.big",
+			10000, []int{1},
+			10000, []int{2},
+			10000, []int{3},
+			60000, []int{4, 5}).
+		AddStack(30000, "a.go:pkg.small:1", "c.go:pkg.caller:7").
+		AddStack(20000, "d.go:pkg.rec:1", "d.go:pkg.rec:2", "d.go:pkg.rec:3").
+		Build()
+
+	index := NewIndex(IndexConfig{Threshold: 1})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key       string
+		value     int64
+		flatValue int64
+		level     int
+		flatLevel int
+	}{
+		{"b.go:pkg.big", 90000, 90000, 5, 5},
+		{"a.go:pkg.small", 80000, 80000, 4, 4},
+		{"c.go:pkg.caller", 30000, 0, 3, 0},
+		{"d.go:pkg.rec", 20000, 20000, 2, 3},
+		{"d.go:pkg.missing", 0, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		have := index.QueryFunc(convertTestKey(test.key))
+		if have.Value != test.value || have.FlatValue != test.flatValue {
+			t.Errorf("QueryFunc(%q): have values %d/%d, want %d/%d",
+				test.key, have.Value, have.FlatValue, test.value, test.flatValue)
+		}
+		if have.HeatLevel != test.level || have.FlatHeatLevel != test.flatLevel {
+			t.Errorf("QueryFunc(%q): have levels %d/%d, want %d/%d",
+				test.key, have.HeatLevel, have.FlatHeatLevel, test.level, test.flatLevel)
+		}
+	}
+}
+
+func TestParallelBuild(t *testing.T) {
+	p := newRandomTestProfile(2, 10000)
+	for _, config := range []IndexConfig{{}, {LeafPackages: []string{"example.com/proj/pkg1"}, StacksPerLine: 4, CallGraph: true}} {
+		config.Parallelism = 1
+		want := NewIndex(config)
+		wantReport, err := want.AddProfileWithReport(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, parallelism := range []int{2, 3, 8} {
+			config.Parallelism = parallelism
+			have := NewIndex(config)
+			haveReport, err := have.AddProfileWithReport(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(wantReport, haveReport); diff != "" {
+				t.Errorf("parallelism=%d: report mismatch (-want +have):\n%s", parallelism, diff)
+			}
+			have.config.Parallelism = 1
+			if !reflect.DeepEqual(want, have) {
+				t.Errorf("parallelism=%d: index differs from the sequential build", parallelism)
+			}
+		}
+	}
+}
+
+func TestIncompleteFunctionsTable(t *testing.T) {
+	p := newRandomTestProfile(3, 5000)
+	config := IndexConfig{StacksPerLine: 2, CallGraph: true}
+	want := NewIndex(config)
+	if err := want.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	functions := p.Function
+	for _, n := range []int{0, len(functions) / 2} {
+		p.Function = functions[:n]
+		have := NewIndex(config)
+		if err := have.AddProfile(p); err != nil {
+			t.Fatalf("%d functions: %v", n, err)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("%d functions: index differs from the complete table build", n)
+		}
+	}
+	p.Function = functions
+}
+
+func TestPruneCold(t *testing.T) {
+	p := newRandomTestProfile(4, 5000)
+	config := IndexConfig{Threshold: 0.2, GlobalPackages: []string{"example.com/proj/pkg1"}, StacksPerLine: 3, CallGraph: true}
+	full := NewIndex(config)
+	if err := full.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	config.PruneCold = true
+	pruned := NewIndex(config)
+	if err := pruned.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned.dataPoints) >= len(full.dataPoints) || pruned.MemoryUsageApprox() >= full.MemoryUsageApprox() {
+		t.Errorf("pruned index size %d is not less than %d",
+			pruned.MemoryUsageApprox(), full.MemoryUsageApprox())
+	}
+
+	eqLevels := func(x, y LineStats) bool {
+		return x.HeatLevel == y.HeatLevel && x.GlobalHeatLevel == y.GlobalHeatLevel &&
+			x.FlatHeatLevel == y.FlatHeatLevel && x.FlatGlobalHeatLevel == y.FlatGlobalHeatLevel &&
+			x.Value == y.Value && x.FlatValue == y.FlatValue
+	}
+	for funcID, key := range full.funcTable.keys {
+		fn := &full.funcs[funcID]
+		numHot := 0
+		for _, pt := range full.dataPoints[fn.dataFrom:fn.dataTo] {
+			want := full.QueryLine(key, int(pt.line))
+			have := pruned.QueryLine(key, int(pt.line))
+			if !pt.flags.HasLevels() {
+				if have != (LineStats{}) {
+					t.Fatalf("QueryLine(%v, %d): found a cold line", key, pt.line)
+				}
+				continue
+			}
+			numHot++
+			if !eqLevels(want, have) {
+				t.Fatalf("QueryLine(%v, %d) mismatch (-want +have):\n%s", key, pt.line, cmp.Diff(want, have))
+			}
+			wantStacks := full.QueryStacks(key, int(pt.line), 3)
+			haveStacks := pruned.QueryStacks(key, int(pt.line), 3)
+			if !reflect.DeepEqual(wantStacks, haveStacks) {
+				t.Fatalf("QueryStacks(%v, %d) mismatch (-want +have):\n%s",
+					key, pt.line, cmp.Diff(wantStacks, haveStacks))
+			}
+		}
+		_, ok := pruned.LookupFunc(key)
+		if ok != (numHot != 0) {
+			t.Fatalf("%v: func with %d hot lines, lookup result is %v", key, numHot, ok)
+		}
+		if ok {
+			if diff := cmp.Diff(full.QueryFunc(key), pruned.QueryFunc(key)); diff != "" {
+				t.Fatalf("QueryFunc(%v) mismatch (-want +have):\n%s", key, diff)
+			}
+		}
+	}
+
+	relevelled := full.Relevel(config)
+	relevelled.config.Parallelism = pruned.config.Parallelism
+	if !reflect.DeepEqual(relevelled, pruned) {
+		t.Errorf("relevelled index differs from the pruned one")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("a.go:pkg.f", 10000, []int{1}).
+		Build()
+	p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+	p.Period = 10000000
+	p.DurationNanos = int64(30 * time.Second)
+	p.TimeNanos = time.Date(2022, 1, 25, 10, 0, 0, 0, time.UTC).UnixNano()
+	p.Comments = []string{"go test -bench=."}
+	p.Mapping = []*profile.Mapping{
+		{File: "/tmp/app.test", BuildID: "abc123"},
+		{File: "/lib/libc.so", BuildID: "def456"},
+	}
+
+	index := NewIndex(IndexConfig{})
+	if index.Metadata().SampleType != "" {
+		t.Fatal("empty index has non-empty metadata")
+	}
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Metadata{
+		SampleType:    "cpu",
+		SampleUnit:    "nanoseconds",
+		PeriodType:    "cpu",
+		PeriodUnit:    "nanoseconds",
+		Period:        10000000,
+		Duration:      30 * time.Second,
+		TimeCollected: time.Unix(0, p.TimeNanos),
+		Comments:      []string{"go test -bench=."},
+		MainBinary:    "/tmp/app.test",
+		BuildID:       "abc123",
+	}
+	have := index.Metadata()
+	if diff := cmp.Diff(have, want); diff != "" {
+		t.Fatalf("metadata mismatch:\n(+want -have)\n%s", diff)
+	}
+	have.Comments[0] = "modified"
+	if index.Metadata().Comments[0] != "go test -bench=." {
+		t.Fatal("metadata comments are not copied")
+	}
+}
+
+func TestFlatHeatLevels(t *testing.T) {
+	p := newTestProfileBuilder().
+		Sorted().
+		AddSamples("a.go:pkg.f",
+			100000, []int{1, 2},
+			50000, []int{3},
+			20000, []int{4}).
+		AddSamples("b.go:pkg.g",
+			10000, []int{7}).
+		Build()
+
+	index := NewIndex(IndexConfig{Threshold: 1})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key        string
+		line       int
+		flatLocal  int
+		flatGlobal int
+	}{
+		{"a.go:pkg.f", 1, 5, 5},
+		{"a.go:pkg.f", 2, 0, 0},
+		{"a.go:pkg.f", 3, 4, 4},
+		{"a.go:pkg.f", 4, 3, 3},
+		{"b.go:pkg.g", 7, 5, 2},
+	}
+
+	for _, test := range tests {
+		have := index.QueryLine(convertTestKey(test.key), test.line)
+		if have.FlatHeatLevel != test.flatLocal || have.FlatGlobalHeatLevel != test.flatGlobal {
+			t.Errorf("QueryLine(%q, %d): have flat levels %d/%d, want %d/%d",
+				test.key, test.line, have.FlatHeatLevel, have.FlatGlobalHeatLevel, test.flatLocal, test.flatGlobal)
+		}
+	}
+}
+
 type testProfileBuilder struct {
 	samples map[string][]testProfileSample
+	stacks  []testProfileStack
 	sorted  bool
 }
 
+// testProfileStack is a sample that spans several functions.
+// Every frame has a "filename:symbol:line" form, the leaf frame goes first.
+type testProfileStack struct {
+	value  int
+	frames []string
+}
+
 type testProfileSample struct {
 	value int
 	lines []int
@@ -869,6 +1534,11 @@ func (b *testProfileBuilder) AddSamples(sym string, pairs ...interface{}) *testP
 	return b
 }
 
+func (b *testProfileBuilder) AddStack(value int, frames ...string) *testProfileBuilder {
+	b.stacks = append(b.stacks, testProfileStack{value: value, frames: frames})
+	return b
+}
+
 func (b *testProfileBuilder) Build() *profile.Profile {
 	p := &profile.Profile{
 		SampleType: []*profile.ValueType{
@@ -904,7 +1574,7 @@ func (b *testProfileBuilder) Build() *profile.Profile {
 
 		for _, s := range symSampleSet {
 			pprofSample := newSample()
-			pprofSample.Value = []int64{0, int64(s.value)}
+			pprofSample.Value = []int64{1, int64(s.value)}
 			dstLoc := pprofSample.Location[0]
 			outSamples = append(outSamples, pprofSample)
 			for _, line := range s.lines {
@@ -916,6 +1586,25 @@ func (b *testProfileBuilder) Build() *profile.Profile {
 		}
 	}
 
+	for _, stack := range b.stacks {
+		pprofSample := &profile.Sample{
+			Value: []int64{1, int64(stack.value)},
+		}
+		for _, frame := range stack.frames {
+			i := strings.LastIndexByte(frame, ':')
+			line, err := strconv.Atoi(frame[i+1:])
+			if err != nil {
+				panic(err)
+			}
+			pprofSample.Location = append(pprofSample.Location, &profile.Location{
+				Line: []profile.Line{
+					{Line: int64(line), Function: getFunction(convertTestKey(frame[:i]))},
+				},
+			})
+		}
+		outSamples = append(outSamples, pprofSample)
+	}
+
 	p.Sample = outSamples
 
 	if b.sorted {
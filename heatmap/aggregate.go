@@ -0,0 +1,137 @@
+package heatmap
+
+import (
+	"sort"
+)
+
+// AggregateStats contains the profile data rolled up by some criteria,
+// like a package, a directory or a file.
+type AggregateStats struct {
+	// Name is a group identifier.
+	// For packages, it's a package import path.
+	// For directories and files, it's a full path.
+	Name string
+
+	// Value is the aggregated cumulative value for this group.
+	// Every sample is counted only once per group, so recursive
+	// or cross-group calls don't inflate this value.
+	Value int64
+
+	// FlatValue is a sum of all "own" samples inside this group.
+	FlatValue int64
+
+	// HeatLevel is a score that is computed among the groups of the same kind.
+	// It follows the same rules as LineStats.HeatLevel.
+	HeatLevel int
+}
+
+// groupStats is a compact form of AggregateStats.
+type groupStats struct {
+	name      string
+	flatValue int64
+	cumValue  int64
+	level     uint8
+}
+
+// valueCounter accumulates the flat and cumulative values
+// of some profile entity, like a function or a package.
+type valueCounter struct {
+	flatValue int64
+	cumValue  int64
+
+	// lastSample is used to count every sample only once
+	// for the cumulative value.
+	lastSample int
+}
+
+func newValueCounters(n int) []valueCounter {
+	counters := make([]valueCounter, n)
+	for i := range counters {
+		counters[i].lastSample = -1
+	}
+	return counters
+}
+
+func (c *valueCounter) AddSample(sampleID int, value int64, isSelf bool) {
+	if isSelf {
+		c.flatValue += value
+	}
+	if c.lastSample != sampleID {
+		c.lastSample = sampleID
+		c.cumValue += value
+	}
+}
+
+// IsUsed reports whether any sample was added to this counter.
+func (c *valueCounter) IsUsed() bool {
+	return c.lastSample != -1
+}
+
+// Merge adds the other counter values.
+// The counters should not share any samples.
+func (c *valueCounter) Merge(other *valueCounter) {
+	c.flatValue += other.flatValue
+	c.cumValue += other.cumValue
+	if other.IsUsed() {
+		c.lastSample = other.lastSample
+	}
+}
+
+func mergeValueCounters(dst, src []valueCounter) {
+	for i := range dst {
+		dst[i].Merge(&src[i])
+	}
+}
+
+// buildGroupStats creates the stats for every used group.
+// The names are expected to be sorted.
+// The second result maps the name index to the group index;
+// for the unused groups it's -1.
+func buildGroupStats(names []string, counters []valueCounter) ([]groupStats, []int32) {
+	groups := make([]groupStats, 0, len(names))
+	groupIndex := make([]int32, len(names))
+	for i, name := range names {
+		c := &counters[i]
+		if !c.IsUsed() {
+			groupIndex[i] = -1
+			continue
+		}
+		groupIndex[i] = int32(len(groups))
+		groups = append(groups, groupStats{
+			name:      name,
+			flatValue: c.flatValue,
+			cumValue:  c.cumValue,
+		})
+	}
+	return groups, groupIndex
+}
+
+func computeGroupLevels(groups []groupStats, threshold float64, minValue int64) {
+	valueOrder := make([]int, len(groups))
+	for i := range groups {
+		valueOrder[i] = i
+		groups[i].level = 0
+	}
+	sort.SliceStable(valueOrder, func(i, j int) bool {
+		return groups[valueOrder[i]].cumValue > groups[valueOrder[j]].cumValue
+	})
+	assignLevels(len(valueOrder), threshold, func(i, level int) {
+		g := &groups[valueOrder[i]]
+		if g.cumValue >= minValue {
+			g.level = uint8(level)
+		}
+	})
+}
+
+func convertGroupStats(groups []groupStats) []AggregateStats {
+	result := make([]AggregateStats, len(groups))
+	for i, g := range groups {
+		result[i] = AggregateStats{
+			Name:      g.name,
+			Value:     g.cumValue,
+			FlatValue: g.flatValue,
+			HeatLevel: int(g.level),
+		}
+	}
+	return result
+}
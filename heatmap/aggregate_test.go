@@ -0,0 +1,62 @@
+package heatmap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAggregateStats(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("/proj/a/x.go:pkga.f",
+			10000, []int{1, 2},
+			20000, []int{3}).
+		AddSamples("/proj/a/y.go:pkga.g",
+			30000, []int{5}).
+		AddSamples("/proj/b/z.go:pkgb.h",
+			5000, []int{1}).
+		Build()
+
+	index := NewIndex(IndexConfig{Threshold: 1})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		have []AggregateStats
+		want []AggregateStats
+	}{
+		{
+			name: "packages",
+			have: index.PackageStats(),
+			want: []AggregateStats{
+				{Name: "pkga", Value: 60000, FlatValue: 60000, HeatLevel: 5},
+				{Name: "pkgb", Value: 5000, FlatValue: 5000, HeatLevel: 4},
+			},
+		},
+		{
+			name: "dirs",
+			have: index.DirStats(),
+			want: []AggregateStats{
+				{Name: "/proj/a", Value: 60000, FlatValue: 60000, HeatLevel: 5},
+				{Name: "/proj/b", Value: 5000, FlatValue: 5000, HeatLevel: 4},
+			},
+		},
+		{
+			name: "files",
+			have: index.FileStats(),
+			want: []AggregateStats{
+				{Name: "/proj/a/x.go", Value: 30000, FlatValue: 30000, HeatLevel: 5},
+				{Name: "/proj/a/y.go", Value: 30000, FlatValue: 30000, HeatLevel: 4},
+				{Name: "/proj/b/z.go", Value: 5000, FlatValue: 5000, HeatLevel: 3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.have, test.want); diff != "" {
+			t.Errorf("%s results mismatch:\n(+want -have)\n%s", test.name, diff)
+		}
+	}
+}
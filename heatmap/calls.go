@@ -0,0 +1,270 @@
+package heatmap
+
+import (
+	"sort"
+)
+
+// CallStats describes the calls from a call site line to a function.
+type CallStats struct {
+	// Caller and Line identify the call site.
+	Caller Key
+	Line   int
+
+	// Callee is a function that is called from the call site.
+	Callee Key
+
+	// Value is the cumulative value of the callee calls from this call site.
+	Value int64
+
+	// NumSamples is the number of samples that contain this call.
+	NumSamples int
+
+	// LineShare is the Value relative to the call site line value.
+	// For example, 0.7 means that the call site line spends 70% of its time in the Callee.
+	LineShare float64
+}
+
+// QueryCallees returns the functions that are called from the given line.
+// The results are sorted by Value in descending order.
+//
+// Only the direct calls are reported.
+// If there are no such calls in the index, nil is returned.
+// The calls are only recorded if IndexConfig.CallGraph is set.
+func (index *Index) QueryCallees(key Key, line int) []CallStats {
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok || line < 0 {
+		return nil
+	}
+	edges := index.callEdges
+	from := sort.Search(len(edges), func(i int) bool {
+		e := &edges[i]
+		return e.callerID > funcID || (e.callerID == funcID && e.line >= uint32(line))
+	})
+	var result []CallStats
+	for i := from; i < len(edges) && edges[i].callerID == funcID && edges[i].line == uint32(line); i++ {
+		result = append(result, index.callStats(&edges[i]))
+	}
+	sortCallStats(result)
+	return result
+}
+
+// QueryCallers returns the call sites that call the given function.
+// The results are sorted by Value in descending order.
+//
+// Only the direct calls are reported.
+// If there are no such calls in the index, nil is returned.
+// The calls are only recorded if IndexConfig.CallGraph is set.
+func (index *Index) QueryCallers(key Key) []CallStats {
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		return nil
+	}
+	order := index.callerOrder
+	from := sort.Search(len(order), func(i int) bool {
+		return index.callEdges[order[i]].calleeID >= funcID
+	})
+	var result []CallStats
+	for i := from; i < len(order) && index.callEdges[order[i]].calleeID == funcID; i++ {
+		result = append(result, index.callStats(&index.callEdges[order[i]]))
+	}
+	sortCallStats(result)
+	return result
+}
+
+func (index *Index) callStats(e *callEdge) CallStats {
+	stats := CallStats{
+		Caller:     index.funcTable.keys[e.callerID],
+		Line:       int(e.line),
+		Callee:     index.funcTable.keys[e.calleeID],
+		Value:      e.value.Nanoseconds(),
+		NumSamples: int(e.numSamples),
+	}
+	if pt := index.findPoint(&index.funcs[e.callerID], e.line); pt != nil && pt.cumValue != 0 {
+		stats.LineShare = float64(e.value) / float64(pt.cumValue)
+	}
+	return stats
+}
+
+// findPoint returns the fn data point for the line.
+// If there is no such point, nil is returned.
+func (index *Index) findPoint(fn *funcIndex, line uint32) *dataPoint {
+	data := index.dataPoints[fn.dataFrom:fn.dataTo]
+	i := sort.Search(len(data), func(i int) bool {
+		return data[i].line >= line
+	})
+	if i < len(data) && data[i].line == line {
+		return &data[i]
+	}
+	return nil
+}
+
+// sortCallStats sorts the calls by value in descending order.
+// The input is expected to be in the edges order, so
+// a stable sort gives a deterministic result.
+func sortCallStats(calls []CallStats) {
+	sort.SliceStable(calls, func(i, j int) bool {
+		return calls[i].Value > calls[j].Value
+	})
+}
+
+// callEdge is an aggregated call from the caller line to the callee.
+type callEdge struct {
+	callerID uint32
+	line     uint32
+	calleeID uint32
+
+	value      durationValue
+	numSamples sampleCount
+}
+
+// addEdge adds the other edge values to this edge.
+func (e *callEdge) addEdge(other *callEdge) {
+	e.value += other.value
+	e.numSamples = e.numSamples.Add(int64(other.numSamples))
+}
+
+// callEdgeBuffer is like pointBuffer, but for the call edges.
+type callEdgeBuffer struct {
+	edges []callEdge
+
+	// numSorted is a length of the sorted and compacted edges prefix.
+	numSorted int
+
+	// scratch holds the new edges while they're merged into the prefix.
+	scratch []callEdge
+}
+
+func (b *callEdgeBuffer) Add(e callEdge) {
+	if len(b.edges) == cap(b.edges) {
+		b.Compact()
+		if len(b.edges) > cap(b.edges)/2 {
+			edges := make([]callEdge, len(b.edges), 2*cap(b.edges)+minPointBufferSize)
+			copy(edges, b.edges)
+			b.edges = edges
+		}
+	}
+	b.edges = append(b.edges, e)
+}
+
+// Compact sorts the edges and merges the duplicates.
+// Like in pointBuffer, only the new edges are sorted.
+func (b *callEdgeBuffer) Compact() {
+	if b.numSorted == len(b.edges) {
+		return
+	}
+	tail := compactCallEdges(b.edges[b.numSorted:])
+	b.scratch = append(b.scratch[:0], tail...)
+	b.edges = mergeSortedCallEdges(b.edges, b.numSorted, b.scratch)
+	b.numSorted = len(b.edges)
+}
+
+func compactCallEdges(edges []callEdge) []callEdge {
+	if len(edges) == 0 {
+		return edges
+	}
+	sort.Sort(callEdgesByCaller(edges))
+	dst := 0
+	for _, e := range edges[1:] {
+		prev := &edges[dst]
+		if e.callerID == prev.callerID && e.line == prev.line && e.calleeID == prev.calleeID {
+			prev.addEdge(&e)
+			continue
+		}
+		dst++
+		edges[dst] = e
+	}
+	return edges[:dst+1]
+}
+
+// mergeSortedCallEdges is like mergeSortedPointRecords, but for the call edges.
+func mergeSortedCallEdges(edges []callEdge, n int, tail []callEdge) []callEdge {
+	i := n - 1
+	k := n + len(tail)
+	for j := len(tail) - 1; j >= 0; {
+		k--
+		if i >= 0 {
+			x := &edges[i]
+			y := &tail[j]
+			if x.callerID == y.callerID && x.line == y.line && x.calleeID == y.calleeID {
+				merged := *x
+				merged.addEdge(y)
+				edges[k] = merged
+				i--
+				j--
+				continue
+			}
+			if callEdgeLess(y, x) {
+				edges[k] = *x
+				i--
+				continue
+			}
+		}
+		edges[k] = tail[j]
+		j--
+	}
+	copy(edges[i+1:], edges[k:n+len(tail)])
+	return edges[:i+1+n+len(tail)-k]
+}
+
+type callEdgesByCaller []callEdge
+
+func (edges callEdgesByCaller) Len() int {
+	return len(edges)
+}
+
+func (edges callEdgesByCaller) Swap(i, j int) {
+	edges[i], edges[j] = edges[j], edges[i]
+}
+
+func (edges callEdgesByCaller) Less(i, j int) bool {
+	return callEdgeLess(&edges[i], &edges[j])
+}
+
+func callEdgeLess(x, y *callEdge) bool {
+	if x.callerID != y.callerID {
+		return x.callerID < y.callerID
+	}
+	if x.line != y.line {
+		return x.line < y.line
+	}
+	return x.calleeID < y.calleeID
+}
+
+// remapCallEdges appends the edges with the func IDs replaced according
+// to the newFuncIDs mapping to dst; the edges of the removed funcs are dropped.
+// The mapping should preserve the func IDs order.
+//
+// dst can be edges[:0] to do the remapping in place.
+func remapCallEdges(dst, edges []callEdge, newFuncIDs []int32) []callEdge {
+	result := dst
+	for _, e := range edges {
+		callerID := newFuncIDs[e.callerID]
+		calleeID := newFuncIDs[e.calleeID]
+		if callerID == -1 || calleeID == -1 {
+			continue
+		}
+		e.callerID = uint32(callerID)
+		e.calleeID = uint32(calleeID)
+		result = append(result, e)
+	}
+	return result
+}
+
+// buildCallerOrder returns the edges indexes sorted by the callee.
+// The func IDs are dense, so a counting sort is used.
+// It's stable, so the callers order is preserved for every callee.
+func buildCallerOrder(edges []callEdge, numFuncs int) []uint32 {
+	offsets := make([]uint32, numFuncs+1)
+	for _, e := range edges {
+		offsets[e.calleeID+1]++
+	}
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	order := make([]uint32, len(edges))
+	for i, e := range edges {
+		order[offsets[e.calleeID]] = uint32(i)
+		offsets[e.calleeID]++
+	}
+	return order
+}
@@ -0,0 +1,176 @@
+package heatmap
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCalls(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddStack(70000, "json.go:json.Unmarshal:10", "a.go:main.f:5").
+		AddStack(30000, "b.go:main.g:3", "a.go:main.f:5").
+		AddStack(20000, "a.go:main.f:5").
+		AddStack(40000, "json.go:json.Unmarshal:12", "c.go:main.h:7").
+		AddStack(10000, "json.go:json.Unmarshal:12", "c.go:main.h:7", "a.go:main.f:6").
+		AddStack(50000, "d.go:main.rec:1", "d.go:main.rec:2", "d.go:main.rec:2").
+		AddStack(10000, "e.go:main.deep:2", "e.go:main.deep:2", "e.go:main.deep:2", "main.go:main.main:1").
+		Build()
+
+	index := NewIndex(IndexConfig{CallGraph: true})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(caller string, line int, callee string, value int64, numSamples int, share float64) CallStats {
+		return CallStats{
+			Caller:     convertTestKey(caller),
+			Line:       line,
+			Callee:     convertTestKey(callee),
+			Value:      value,
+			NumSamples: numSamples,
+			LineShare:  share,
+		}
+	}
+
+	tests := []struct {
+		name string
+		have []CallStats
+		want []CallStats
+	}{
+		{
+			name: "callees f:5",
+			have: index.QueryCallees(convertTestKey("a.go:main.f"), 5),
+			want: []CallStats{
+				call("a.go:main.f", 5, "json.go:json.Unmarshal", 70000, 1, 70.0/120.0),
+				call("a.go:main.f", 5, "b.go:main.g", 30000, 1, 0.25),
+			},
+		},
+		{
+			name: "callees f:6",
+			have: index.QueryCallees(convertTestKey("a.go:main.f"), 6),
+			want: []CallStats{
+				call("a.go:main.f", 6, "c.go:main.h", 10000, 1, 1),
+			},
+		},
+		{
+			name: "callees f:7",
+			have: index.QueryCallees(convertTestKey("a.go:main.f"), 7),
+		},
+		{
+			name: "callees Unmarshal:10",
+			have: index.QueryCallees(convertTestKey("json.go:json.Unmarshal"), 10),
+		},
+		{
+			name: "callers Unmarshal",
+			have: index.QueryCallers(convertTestKey("json.go:json.Unmarshal")),
+			want: []CallStats{
+				call("a.go:main.f", 5, "json.go:json.Unmarshal", 70000, 1, 70.0/120.0),
+				call("c.go:main.h", 7, "json.go:json.Unmarshal", 50000, 2, 1),
+			},
+		},
+		{
+			name: "callers f",
+			have: index.QueryCallers(convertTestKey("a.go:main.f")),
+		},
+		{
+			name: "callers rec",
+			have: index.QueryCallers(convertTestKey("d.go:main.rec")),
+			want: []CallStats{
+				// Recursive calls count the sample only once.
+				call("d.go:main.rec", 2, "d.go:main.rec", 50000, 1, 1),
+			},
+		},
+		{
+			name: "callees deep:2",
+			have: index.QueryCallees(convertTestKey("e.go:main.deep"), 2),
+			want: []CallStats{
+				call("e.go:main.deep", 2, "e.go:main.deep", 10000, 1, 1),
+			},
+		},
+		{
+			name: "callers missing",
+			have: index.QueryCallers(convertTestKey("x.go:main.missing")),
+		},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, test.have); diff != "" {
+			t.Errorf("%s: results mismatch (-want +have):\n%s", test.name, diff)
+		}
+	}
+
+	// The calls to the removed functions are not included.
+	filtered := index.Filter(func(info FuncInfo) bool {
+		return info.PkgName == "main"
+	})
+	want := []CallStats{
+		call("a.go:main.f", 5, "b.go:main.g", 30000, 1, 0.25),
+	}
+	if diff := cmp.Diff(want, filtered.QueryCallees(convertTestKey("a.go:main.f"), 5)); diff != "" {
+		t.Errorf("filtered callees mismatch (-want +have):\n%s", diff)
+	}
+	if have := filtered.QueryCallers(convertTestKey("json.go:json.Unmarshal")); have != nil {
+		t.Errorf("filtered callers: expected nil, got %v", have)
+	}
+
+	// No calls are recorded by default.
+	index = NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	if have := index.QueryCallees(convertTestKey("a.go:main.f"), 5); have != nil {
+		t.Errorf("QueryCallees without CallGraph: expected nil, got %v", have)
+	}
+	if have := index.QueryCallers(convertTestKey("json.go:json.Unmarshal")); have != nil {
+		t.Errorf("QueryCallers without CallGraph: expected nil, got %v", have)
+	}
+}
+
+func TestCallEdgeBuffer(t *testing.T) {
+	type edgeKey struct {
+		callerID uint32
+		line     uint32
+		calleeID uint32
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, numUnique := range []int{1, 10, 5000, 20000} {
+		var b callEdgeBuffer
+		want := map[edgeKey]callEdge{}
+		for i := 0; i < 50000; i++ {
+			id := r.Intn(numUnique)
+			e := callEdge{
+				callerID:   uint32(id % 97),
+				line:       uint32(id),
+				calleeID:   uint32(id % 13),
+				value:      durationValue(r.Intn(100)),
+				numSamples: 1,
+			}
+			b.Add(e)
+			key := edgeKey{callerID: e.callerID, line: e.line, calleeID: e.calleeID}
+			wantEdge := want[key]
+			wantEdge.callerID = key.callerID
+			wantEdge.line = key.line
+			wantEdge.calleeID = key.calleeID
+			wantEdge.value += e.value
+			wantEdge.numSamples++
+			want[key] = wantEdge
+		}
+		b.Compact()
+
+		if len(b.edges) != len(want) {
+			t.Fatalf("unique=%d: have %d edges, want %d", numUnique, len(b.edges), len(want))
+		}
+		for i, e := range b.edges {
+			if i != 0 && !callEdgesByCaller(b.edges).Less(i-1, i) {
+				t.Fatalf("unique=%d: edges are not sorted at %d", numUnique, i)
+			}
+			key := edgeKey{callerID: e.callerID, line: e.line, calleeID: e.calleeID}
+			if want[key] != e {
+				t.Fatalf("unique=%d: %v: have %+v, want %+v", numUnique, key, e, want[key])
+			}
+		}
+	}
+}
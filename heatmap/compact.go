@@ -0,0 +1,276 @@
+package heatmap
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// CompactIndex is a read-only form of Index that takes less memory.
+// It's useful when a lot of indexes need to be kept in memory.
+//
+// The data points are delta-encoded with varints, so every query
+// has to decode the function data points up to the requested line.
+// This makes the queries a bit slower than the Index ones.
+//
+// The query results are identical to the original Index results.
+type CompactIndex struct {
+	funcTable funcTable
+	funcs     []compactFunc
+
+	// data holds all encoded data points.
+	// See encodeCompactPoint for the format details.
+	data []byte
+
+	totalValue  int64
+	valuePeriod int64
+	numGlobal   uint32
+}
+
+type compactFunc struct {
+	minLine uint32
+	maxLine uint32
+
+	// dataOffset is a func data points offset inside the CompactIndex.data.
+	dataOffset uint32
+	numPoints  uint32
+
+	inGlobalRanking bool
+}
+
+// compactPoint is a decoded data point with its precomputed ranks.
+type compactPoint struct {
+	pt dataPoint
+
+	// numLocalGreater is a number of func points with a greater value.
+	numLocalGreater uint32
+
+	// numGlobalGreater is a number of globally ranked points with a greater value.
+	// Only encoded for the funcs that participate in the global ranking.
+	numGlobalGreater uint32
+}
+
+// Compact creates a read-only compressed copy of the index.
+func (index *Index) Compact() *CompactIndex {
+	result := &CompactIndex{
+		funcTable:   index.funcTable,
+		funcs:       make([]compactFunc, len(index.funcs)),
+		totalValue:  index.totalValue,
+		valuePeriod: index.valuePeriod,
+		numGlobal:   uint32(len(index.globalValues)),
+	}
+
+	var data []byte
+	for i := range index.funcs {
+		fn := &index.funcs[i]
+		points := index.dataPoints[fn.dataFrom:fn.dataTo]
+		result.funcs[i] = compactFunc{
+			minLine:         fn.minLine,
+			maxLine:         fn.maxLine,
+			dataOffset:      uint32(len(data)),
+			numPoints:       uint32(len(points)),
+			inGlobalRanking: fn.inGlobalRanking,
+		}
+
+		prevLine := fn.minLine
+		for j, pt := range points {
+			cp := compactPoint{
+				pt:              pt,
+				numLocalGreater: index.numLocalGreater[fn.dataFrom+uint32(j)],
+			}
+			if fn.inGlobalRanking {
+				cp.numGlobalGreater = uint32(countGreater(index.globalValues, pt.cumValue))
+			}
+			data = encodeCompactPoint(data, prevLine, &cp, fn.inGlobalRanking)
+			prevLine = pt.line
+		}
+	}
+
+	// Don't keep the excess capacity.
+	result.data = make([]byte, len(data))
+	copy(result.data, data)
+
+	return result
+}
+
+// MemoryUsageApprox returns the approximate size of this index in bytes.
+// Note: it implies 64-bit architecture.
+func (index *CompactIndex) MemoryUsageApprox() int {
+	size := 0
+	size += funcTableMemoryUsage(&index.funcTable)
+	size += cap(index.funcs) * 20
+	size += cap(index.data)
+	return size
+}
+
+// QueryLineRange is like Index.QueryLineRange.
+func (index *CompactIndex) QueryLineRange(key Key, lineFrom, lineTo int, callback func(stats LineStats) bool) {
+	if lineFrom == lineTo {
+		callback(index.QueryLine(key, lineFrom))
+		return
+	}
+	if lineFrom > lineTo {
+		panic("lineFrom > lineTo")
+	}
+
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		return
+	}
+	fn := &index.funcs[funcID]
+	if int(fn.maxLine) < lineFrom || int(fn.minLine) > lineTo {
+		return
+	}
+
+	index.walkFunc(fn, func(cp *compactPoint) bool {
+		line := int(cp.pt.line)
+		if line < lineFrom {
+			return true
+		}
+		if line > lineTo {
+			return false
+		}
+		return callback(index.lineStats(fn, cp))
+	})
+}
+
+// QueryLine is like Index.QueryLine.
+func (index *CompactIndex) QueryLine(key Key, line int) LineStats {
+	var result LineStats
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		return result
+	}
+	fn := &index.funcs[funcID]
+	if line < int(fn.minLine) || line > int(fn.maxLine) {
+		return result
+	}
+
+	index.walkFunc(fn, func(cp *compactPoint) bool {
+		if int(cp.pt.line) < line {
+			return true
+		}
+		if int(cp.pt.line) == line {
+			result = index.lineStats(fn, cp)
+		}
+		return false
+	})
+	return result
+}
+
+// QueryLines is like Index.QueryLines.
+func (index *CompactIndex) QueryLines(key Key, lines []int, out []LineStats) {
+	if len(out) < len(lines) {
+		panic("len(out) < len(lines)")
+	}
+	clearLineStats(out[:len(lines)])
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok || len(lines) == 0 {
+		return
+	}
+	fn := &index.funcs[funcID]
+
+	i := 0
+	index.walkFunc(fn, func(cp *compactPoint) bool {
+		line := int(cp.pt.line)
+		for i < len(lines) && lines[i] < line {
+			i++
+		}
+		for i < len(lines) && lines[i] == line {
+			out[i] = index.lineStats(fn, cp)
+			i++
+		}
+		return i < len(lines)
+	})
+}
+
+func (index *CompactIndex) lineStats(fn *compactFunc, cp *compactPoint) (stats LineStats) {
+	cp.pt.setStats(&stats)
+	stats.LocalRank = float64(fn.numPoints-cp.numLocalGreater) / float64(fn.numPoints)
+	if fn.inGlobalRanking {
+		stats.GlobalRank = float64(index.numGlobal-cp.numGlobalGreater) / float64(index.numGlobal)
+	}
+	setValueStats(&stats, &cp.pt, index.totalValue, index.valuePeriod)
+	return stats
+}
+
+// walkFunc decodes the func data points in the line order.
+// Returning false from the visit func stops the iteration.
+func (index *CompactIndex) walkFunc(fn *compactFunc, visit func(cp *compactPoint) bool) {
+	data := index.data[fn.dataOffset:]
+	line := fn.minLine
+	var cp compactPoint
+	for i := uint32(0); i < fn.numPoints; i++ {
+		data = decodeCompactPoint(data, line, &cp, fn.inGlobalRanking)
+		line = cp.pt.line
+		if !visit(&cp) {
+			return
+		}
+	}
+}
+
+// encodeCompactPoint appends the encoded point to the dst.
+//
+// Every point is a sequence of uvarints:
+//
+//	line delta (relative to the previous func point line)
+//	flags
+//	num samples
+//	cum value
+//	flat value
+//	num local greater
+//	num global greater (only if the func is globally ranked)
+func encodeCompactPoint(dst []byte, prevLine uint32, cp *compactPoint, global bool) []byte {
+	dst = appendUvarint(dst, uint64(cp.pt.line-prevLine))
+	dst = appendUvarint(dst, uint64(cp.pt.flags))
+	dst = appendUvarint(dst, uint64(cp.pt.numSamples))
+	dst = appendUvarint(dst, uint64(cp.pt.cumValue))
+	dst = appendUvarint(dst, uint64(cp.pt.flatValue))
+	dst = appendUvarint(dst, uint64(cp.numLocalGreater))
+	if global {
+		dst = appendUvarint(dst, uint64(cp.numGlobalGreater))
+	}
+	return dst
+}
+
+// decodeCompactPoint is an encodeCompactPoint inverse operation.
+// It returns the remaining data.
+func decodeCompactPoint(data []byte, prevLine uint32, cp *compactPoint, global bool) []byte {
+	var v uint64
+	data, v = readUvarint(data)
+	cp.pt.line = prevLine + uint32(v)
+	data, v = readUvarint(data)
+	cp.pt.flags = dataPointFlags(v)
+	data, v = readUvarint(data)
+	cp.pt.numSamples = sampleCount(v)
+	data, v = readUvarint(data)
+	cp.pt.cumValue = durationValue(v)
+	data, v = readUvarint(data)
+	cp.pt.flatValue = durationValue(v)
+	data, v = readUvarint(data)
+	cp.numLocalGreater = uint32(v)
+	cp.numGlobalGreater = 0
+	if global {
+		data, v = readUvarint(data)
+		cp.numGlobalGreater = uint32(v)
+	}
+	return data
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func readUvarint(data []byte) ([]byte, uint64) {
+	v, n := binary.Uvarint(data)
+	return data[n:], v
+}
+
+// countGreater returns the number of values that are greater than v.
+// The values are expected to be sorted in descending order.
+func countGreater(values []durationValue, v durationValue) int {
+	return sort.Search(len(values), func(i int) bool {
+		return values[i] <= v
+	})
+}
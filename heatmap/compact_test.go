@@ -0,0 +1,96 @@
+package heatmap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompactIndex(t *testing.T) {
+	indexes := []*Index{
+		NewIndex(IndexConfig{}),
+		NewIndex(IndexConfig{Threshold: 1, GlobalPackages: []string{"example.com/proj/pkg1"}}),
+	}
+	p := newRandomTestProfile(3, 2000)
+	for _, index := range indexes {
+		if err := index.AddProfile(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bench := range benchIndexList {
+		indexes = append(indexes, bench.i)
+	}
+
+	for i, index := range indexes {
+		compact := index.Compact()
+		if compact.MemoryUsageApprox() >= index.MemoryUsageApprox() {
+			t.Errorf("index%d: compact size %d is not less than %d",
+				i, compact.MemoryUsageApprox(), index.MemoryUsageApprox())
+		}
+
+		for funcID, key := range index.funcTable.keys {
+			fn := &index.funcs[funcID]
+			for line := int(fn.minLine) - 1; line <= int(fn.maxLine)+1; line++ {
+				want := index.QueryLine(key, line)
+				have := compact.QueryLine(key, line)
+				if want != have {
+					t.Fatalf("index%d: QueryLine(%v, %d) mismatch (-want +have):\n%s",
+						i, key, line, cmp.Diff(want, have))
+				}
+			}
+
+			lines := []int{int(fn.minLine) - 1, int(fn.minLine), int(fn.minLine) + 1, int(fn.maxLine), int(fn.maxLine)}
+			want := make([]LineStats, len(lines))
+			index.QueryLines(key, lines, want)
+			have := make([]LineStats, len(lines))
+			compact.QueryLines(key, lines, have)
+			if !lineStatsEqual(want, have) {
+				t.Fatalf("index%d: QueryLines(%v, %v) mismatch (-want +have):\n%s",
+					i, key, lines, cmp.Diff(want, have))
+			}
+
+			ranges := [][2]int{
+				{int(fn.minLine), int(fn.maxLine)},
+				{int(fn.minLine) - 10, int(fn.minLine)},
+				{int(fn.minLine) + 1, int(fn.maxLine) - 1},
+				{int(fn.maxLine), int(fn.maxLine) + 10},
+			}
+			for _, r := range ranges {
+				if r[0] > r[1] {
+					continue
+				}
+				var want, have []LineStats
+				index.QueryLineRange(key, r[0], r[1], func(s LineStats) bool {
+					want = append(want, s)
+					return true
+				})
+				compact.QueryLineRange(key, r[0], r[1], func(s LineStats) bool {
+					have = append(have, s)
+					return true
+				})
+				if !lineStatsEqual(want, have) {
+					diff := cmp.Diff(want, have)
+					t.Fatalf("index%d: QueryLineRange(%v, %d, %d) mismatch (-want +have):\n%s",
+						i, key, r[0], r[1], diff)
+				}
+			}
+		}
+
+		missing := Key{FuncName: "missing", Filename: "missing.go"}
+		if compact.QueryLine(missing, 10) != (LineStats{}) {
+			t.Errorf("index%d: non-empty result for a missing func", i)
+		}
+	}
+}
+
+func lineStatsEqual(x, y []LineStats) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package heatmap
+
+import (
+	"math"
+)
+
+// confidenceZ is a z-score for the 95% confidence level.
+const confidenceZ = 1.96
+
+// computeValuePeriod returns a period that is used to convert the data point
+// values into the samples number, or 0 if the recorded samples number
+// should be used instead.
+//
+// Some profiles don't have a real samples count: for example,
+// the scaled profiles or the profiles converted from other formats.
+// If the sampling period is known, such profiles are detected by comparing
+// the total value with the samples count multiplied by the period.
+// For the usual Go CPU profiles the recorded samples number is used,
+// as it counts the recursive calls samples only once.
+//
+// The profile duration is not needed here: the sampling period
+// already defines how many samples a value is made of.
+func computeValuePeriod(totalValue, totalSamples, samplingPeriod int64) int64 {
+	if samplingPeriod <= 0 {
+		return 0
+	}
+	countedValue := float64(totalSamples) * float64(samplingPeriod)
+	if math.Abs(float64(totalValue)-countedValue) <= 0.01*float64(totalValue) {
+		return 0
+	}
+	return samplingPeriod
+}
+
+// expectedSamples returns the number of samples the pt value is based on.
+// See computeValuePeriod.
+func expectedSamples(pt *dataPoint, valuePeriod int64) float64 {
+	if valuePeriod != 0 {
+		return float64(pt.cumValue.Nanoseconds()) / float64(valuePeriod)
+	}
+	return float64(pt.numSamples)
+}
+
+// sampleInterval returns the approximate 95% Poisson confidence interval
+// for the number of samples.
+//
+// The samples are taken with a fixed period, so the number of
+// samples that hit some line is a Poisson-distributed value.
+// We use the normal approximation here: n ± z*sqrt(n).
+func sampleInterval(n float64) (low, high float64) {
+	halfWidth := confidenceZ * math.Sqrt(n)
+	low = n - halfWidth
+	if low < 0 {
+		low = 0
+	}
+	high = n + halfWidth
+	return low, high
+}
+
+// sampleConfidence returns a [0, 1] estimate of how reliable the value
+// that is based on n samples is.
+//
+// It's 1 minus the relative half-width of the confidence interval.
+// For instance, 4 samples give ~0.02 confidence,
+// 100 samples give ~0.8 and 1000 samples give ~0.94.
+func sampleConfidence(n float64) float64 {
+	if n == 0 {
+		return 0
+	}
+	_, high := sampleInterval(n)
+	return intervalConfidence(n, high)
+}
+
+// intervalConfidence is like sampleConfidence, but it uses
+// the already computed interval upper bound for n.
+func intervalConfidence(n, high float64) float64 {
+	c := 1 - (high-n)/n
+	if c < 0 {
+		return 0
+	}
+	return c
+}
@@ -2,13 +2,27 @@ package heatmap
 
 import (
 	"fmt"
+	"math"
 )
 
 const maxHeatLevel = 5
 
 type funcIndex struct {
-	maxLocalLevel  uint8
-	maxGlobalLevel uint8
+	maxLocalLevel      uint8
+	maxGlobalLevel     uint8
+	maxLocalFlatLevel  uint8
+	maxGlobalFlatLevel uint8
+
+	// Function-level heat levels, see FuncInfo.
+	level     uint8
+	flatLevel uint8
+
+	// inGlobalRanking reports whether this function data points
+	// participate in the global heat levels ranking.
+	//
+	// It's placed next to the other byte-sized fields,
+	// so the struct takes 48 bytes without padding.
+	inGlobalRanking bool
 
 	// Line ranges inside a containing file.
 	minLine uint32
@@ -19,6 +33,14 @@ type funcIndex struct {
 	dataTo   uint32
 
 	fileID uint32
+
+	// pkgID is an index inside Index.pkgStats.
+	pkgID uint32
+
+	// Aggregated function values in nanoseconds.
+	// Every sample is counted only once for the cumValue.
+	flatValue int64
+	cumValue  int64
 }
 
 func (fn *funcIndex) NumPoints() int {
@@ -34,15 +56,28 @@ func (fn *funcIndex) NumPoints() int {
 //
 // The saved 32 bits go into the extra metadata.
 // The first 16 bits are occupied by dataPointFlags.
-// The Other 16 bits are unused for now.
+// The other 16 bits store the number of samples that contributed
+// to this data point. It saturates at math.MaxUint16.
 //
 // The sample values are recorded in microseconds instead of the raw
 // nanoseconds. We do this to encode more time in uint32 value.
 type dataPoint struct {
-	line      uint32
-	flags     dataPointFlags
-	flatValue durationValue
-	cumValue  durationValue
+	line       uint32
+	flags      dataPointFlags
+	numSamples sampleCount
+	flatValue  durationValue
+	cumValue   durationValue
+}
+
+type sampleCount uint16
+
+// Add returns the sum of n and delta, saturating at math.MaxUint16.
+func (n sampleCount) Add(delta int64) sampleCount {
+	sum := int64(n) + delta
+	if sum > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return sampleCount(sum)
 }
 
 type durationValue uint32
@@ -50,55 +85,106 @@ type durationValue uint32
 func (v durationValue) Nanoseconds() int64 { return int64(v) * 1000 }
 func (v durationValue) Microsecond() int64 { return int64(v) }
 
-func (pt *dataPoint) Stats() LineStats {
-	return LineStats{
-		LineNum:         int(pt.line),
-		Value:           pt.cumValue.Nanoseconds(),
-		FlatValue:       pt.flatValue.Nanoseconds(),
-		HeatLevel:       pt.flags.GetLocalLevel(),
-		GlobalHeatLevel: pt.flags.GetGlobalLevel(),
-	}
+// addPoint adds the other point values to this point.
+func (pt *dataPoint) addPoint(other *dataPoint) {
+	pt.cumValue += other.cumValue
+	pt.flatValue += other.flatValue
+	pt.numSamples = pt.numSamples.Add(int64(other.numSamples))
+}
+
+// setStats fills the LineStats fields that depend only on the data point.
+// The other fields are expected to be zero.
+func (pt *dataPoint) setStats(stats *LineStats) {
+	stats.LineNum = int(pt.line)
+	stats.Value = pt.cumValue.Nanoseconds()
+	stats.FlatValue = pt.flatValue.Nanoseconds()
+	stats.NumSamples = int(pt.numSamples)
+	stats.HeatLevel = pt.flags.GetLocalLevel()
+	stats.GlobalHeatLevel = pt.flags.GetGlobalLevel()
+	stats.FlatHeatLevel = pt.flags.GetLocalFlatLevel()
+	stats.FlatGlobalHeatLevel = pt.flags.GetGlobalFlatLevel()
 }
 
 func (pt dataPoint) String() string {
-	return fmt.Sprintf("{%d/flat %d/cum %s}",
-		pt.flatValue.Nanoseconds(), pt.cumValue.Nanoseconds(), pt.flags)
+	return fmt.Sprintf("{%d/flat %d/cum %d/samples %s}",
+		pt.flatValue.Nanoseconds(), pt.cumValue.Nanoseconds(), pt.numSamples, pt.flags)
 }
 
 // Upper 3 bits are for the local level value.
 // Next 3 bits are for the global level value.
-// Other (10) lower bits are bit flags.
+// Next 3 bits are for the local flat level value.
+// Next 3 bits are for the global flat level value.
+// Other (4) lower bits are bit flags.
 type dataPointFlags uint16
 
+const (
+	localLevelShift      = 16 - 3
+	globalLevelShift     = 16 - 6
+	localFlatLevelShift  = 16 - 9
+	globalFlatLevelShift = 16 - 12
+)
+
 func (flags dataPointFlags) String() string {
-	return fmt.Sprintf("<local=%d global=%d>",
-		flags.GetLocalLevel(), flags.GetGlobalLevel())
+	return fmt.Sprintf("<local=%d global=%d flatlocal=%d flatglobal=%d>",
+		flags.GetLocalLevel(), flags.GetGlobalLevel(), flags.GetLocalFlatLevel(), flags.GetGlobalFlatLevel())
 }
 
 func (flags *dataPointFlags) GetLocalLevel() int {
-	const mask = (0b111 << (16 - 3))
-	return int(*flags&mask) >> (16 - 3)
+	return flags.getLevel(localLevelShift)
 }
 
 func (flags *dataPointFlags) GetGlobalLevel() int {
-	const mask = (0b111 << (16 - 6))
-	return int(*flags&mask) >> (16 - 6)
+	return flags.getLevel(globalLevelShift)
+}
+
+func (flags *dataPointFlags) GetLocalFlatLevel() int {
+	return flags.getLevel(localFlatLevelShift)
+}
+
+func (flags *dataPointFlags) GetGlobalFlatLevel() int {
+	return flags.getLevel(globalFlatLevelShift)
 }
 
 func (flags *dataPointFlags) SetLocalLevel(level int) {
-	if level < 0 || level > maxHeatLevel {
-		panic("invalid level value") // Should never happen.
-	}
-	const mask = (0b111 << (16 - 3))
-	*(*uint16)(flags) &^= mask
-	*(*uint16)(flags) |= uint16(level) << (16 - 3)
+	flags.setLevel(localLevelShift, level)
 }
 
 func (flags *dataPointFlags) SetGlobalLevel(level int) {
+	flags.setLevel(globalLevelShift, level)
+}
+
+func (flags *dataPointFlags) SetLocalFlatLevel(level int) {
+	flags.setLevel(localFlatLevelShift, level)
+}
+
+func (flags *dataPointFlags) SetGlobalFlatLevel(level int) {
+	flags.setLevel(globalFlatLevelShift, level)
+}
+
+// HasLevels reports whether any of the heat levels is not 0.
+func (flags dataPointFlags) HasLevels() bool {
+	// All level bits are located above the bit flags.
+	return uint16(flags)>>globalFlatLevelShift != 0
+}
+
+// ClearLevels sets all heat levels to 0.
+func (flags *dataPointFlags) ClearLevels() {
+	flags.SetLocalLevel(0)
+	flags.SetGlobalLevel(0)
+	flags.SetLocalFlatLevel(0)
+	flags.SetGlobalFlatLevel(0)
+}
+
+func (flags *dataPointFlags) getLevel(shift uint) int {
+	mask := uint16(0b111 << shift)
+	return int(uint16(*flags)&mask) >> shift
+}
+
+func (flags *dataPointFlags) setLevel(shift uint, level int) {
 	if level < 0 || level > maxHeatLevel {
 		panic("invalid level value") // Should never happen.
 	}
-	const mask = (0b111 << (16 - 6))
+	mask := uint16(0b111 << shift)
 	*(*uint16)(flags) &^= mask
-	*(*uint16)(flags) |= uint16(level) << (16 - 6)
+	*(*uint16)(flags) |= uint16(level) << shift
 }
@@ -2,8 +2,32 @@ package heatmap
 
 import (
 	"testing"
+	"unsafe"
 )
 
+func TestDataSizes(t *testing.T) {
+	// These sizes are used by the MemoryUsageApprox.
+	tests := []struct {
+		name string
+		have uintptr
+		want uintptr
+	}{
+		{"dataPoint", unsafe.Sizeof(dataPoint{}), 16},
+		{"funcIndex", unsafe.Sizeof(funcIndex{}), 48},
+		{"callEdge", unsafe.Sizeof(callEdge{}), 20},
+		{"stackNode", unsafe.Sizeof(stackNode{}), 12},
+		{"stackRecord", unsafe.Sizeof(stackRecord{}), 12},
+		{"lineStack", unsafe.Sizeof(lineStack{}), 12},
+		{"groupStats", unsafe.Sizeof(groupStats{}), 40},
+		{"compactFunc", unsafe.Sizeof(compactFunc{}), 20},
+	}
+	for _, test := range tests {
+		if test.have != test.want {
+			t.Errorf("%s: have %d bytes, want %d", test.name, test.have, test.want)
+		}
+	}
+}
+
 func TestDataPointFlagsLevel(t *testing.T) {
 	tests := []int{0, 1, 3, maxHeatLevel}
 	for _, test := range tests {
@@ -56,4 +80,20 @@ func TestDataPointFlagsLevel(t *testing.T) {
 			}
 		}
 	}
+
+	for i := 0; i <= maxHeatLevel; i++ {
+		for j := 0; j <= maxHeatLevel; j++ {
+			var f dataPointFlags
+			f.SetLocalLevel(j)
+			f.SetGlobalLevel(i)
+			f.SetLocalFlatLevel(i)
+			f.SetGlobalFlatLevel(j)
+			if f.GetLocalLevel() != j || f.GetGlobalLevel() != i {
+				t.Fatalf("[%d, %d] => cum levels mismatch", i, j)
+			}
+			if f.GetLocalFlatLevel() != i || f.GetGlobalFlatLevel() != j {
+				t.Fatalf("[%d, %d] => flat levels mismatch", i, j)
+			}
+		}
+	}
 }
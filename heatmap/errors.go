@@ -0,0 +1,58 @@
+package heatmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrIndexNotEmpty is returned when a profile is added to an index
+	// that already contains some profile data.
+	// Merging several profiles is not implemented yet.
+	ErrIndexNotEmpty = errors.New("unimplemented yet: adding several profiles")
+
+	// ErrInvalidProfile is returned for profiles that don't have
+	// the expected format.
+	// More specific errors, like SampleValueError, wrap it.
+	ErrInvalidProfile = errors.New("invalid profile")
+
+	// ErrNoSamples is returned when a profile has no samples
+	// that could be indexed.
+	// See AddProfileWithReport to find out why the samples were dropped.
+	ErrNoSamples = errors.New("found no suitable samples")
+
+	// ErrTooManyDataPoints is returned when the number of unique
+	// profile lines doesn't fit into the index.
+	ErrTooManyDataPoints = errors.New("too many samples")
+
+	// ErrNoFocusFuncs is returned by Index.WriteDOT when
+	// there are no functions that match the GraphConfig.Focus.
+	ErrNoFocusFuncs = errors.New("no functions match the graph focus")
+)
+
+// UnsupportedSampleTypeError is returned for profiles of unsupported kind.
+// Right now only cpu/nanoseconds profiles can be indexed.
+type UnsupportedSampleTypeError struct {
+	Type string
+	Unit string
+}
+
+func (e *UnsupportedSampleTypeError) Error() string {
+	return fmt.Sprintf("can't handle %s/%s samples yet", e.Type, e.Unit)
+}
+
+// SampleValueError is returned for samples that have a negative value.
+// Samples with a value that is too small to be indexed are
+// not an error, see DropSmallValue.
+//
+// It wraps ErrInvalidProfile.
+type SampleValueError struct {
+	// Value is a sample value in nanoseconds.
+	Value int64
+}
+
+func (e *SampleValueError) Error() string {
+	return fmt.Sprintf("found a negative sample value (%d ns)", e.Value)
+}
+
+func (e *SampleValueError) Unwrap() error { return ErrInvalidProfile }
@@ -0,0 +1,67 @@
+package heatmap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestAddProfileErrors(t *testing.T) {
+	newProfile := func() *profile.Profile {
+		return newTestProfileBuilder().
+			AddSamples("a.go:pkg.f", 10000, []int{1}).
+			Build()
+	}
+
+	t.Run("IndexNotEmpty", func(t *testing.T) {
+		index := NewIndex(IndexConfig{})
+		if err := index.AddProfile(newProfile()); err != nil {
+			t.Fatal(err)
+		}
+		err := index.AddProfile(newProfile())
+		if !errors.Is(err, ErrIndexNotEmpty) {
+			t.Fatalf("have %v error, want ErrIndexNotEmpty", err)
+		}
+	})
+
+	t.Run("InvalidProfile", func(t *testing.T) {
+		p := newProfile()
+		p.SampleType = p.SampleType[:1]
+		err := NewIndex(IndexConfig{}).AddProfile(p)
+		if !errors.Is(err, ErrInvalidProfile) {
+			t.Fatalf("have %v error, want ErrInvalidProfile", err)
+		}
+	})
+
+	t.Run("UnsupportedSampleType", func(t *testing.T) {
+		p := newProfile()
+		p.SampleType[1] = &profile.ValueType{Type: "space", Unit: "bytes"}
+		err := NewIndex(IndexConfig{}).AddProfile(p)
+		var typeErr *UnsupportedSampleTypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatalf("have %v error, want UnsupportedSampleTypeError", err)
+		}
+		if typeErr.Type != "space" || typeErr.Unit != "bytes" {
+			t.Fatalf("have %s/%s sample type, want space/bytes", typeErr.Type, typeErr.Unit)
+		}
+	})
+
+	t.Run("SampleValue", func(t *testing.T) {
+		p := newTestProfileBuilder().
+			AddSamples("a.go:pkg.f", 10000, []int{1}).
+			AddSamples("a.go:pkg.f", -10000, []int{1}).
+			Build()
+		err := NewIndex(IndexConfig{}).AddProfile(p)
+		var valueErr *SampleValueError
+		if !errors.As(err, &valueErr) {
+			t.Fatalf("have %v error, want SampleValueError", err)
+		}
+		if valueErr.Value != -10000 {
+			t.Fatalf("have %d value, want -10000", valueErr.Value)
+		}
+		if !errors.Is(err, ErrInvalidProfile) {
+			t.Fatalf("SampleValueError doesn't match ErrInvalidProfile")
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package heatmap
+
+import (
+	"path/filepath"
+)
+
+// Filter creates a new index that contains only the functions
+// that match the predicate.
+// It's useful when only a part of the profile is relevant,
+// like the packages of a single module or a single directory.
+//
+// The result keeps the original heat levels and ranks,
+// so the queries for the remaining functions return the same results.
+// The global ranks are still computed against the original index data points.
+// Use Relevel on the result to recompute all levels within the subset.
+//
+// The package, directory and file stats are limited to the groups
+// of the remaining functions; their values are not changed.
+// The calls from or to the removed functions are not included.
+func (index *Index) Filter(pred func(info FuncInfo) bool) *Index {
+	result := &Index{
+		funcs:        make([]funcIndex, 0),
+		globalValues: index.globalValues,
+		totalValue:   index.totalValue,
+		metadata:     index.metadata,
+		valuePeriod:  index.valuePeriod,
+		config:       index.config,
+	}
+
+	// Collect the matching funcs along with their data points.
+	// The keys order is preserved, so the new func IDs are still
+	// sorted in the same way as the original ones.
+	var keys []Key
+	newFuncIDs := make([]int32, len(index.funcs))
+	usedPkgs := make([]bool, len(index.pkgStats))
+	usedFiles := make([]bool, len(index.fileStats))
+	usedDirs := map[string]bool{}
+	for funcID, key := range index.funcTable.keys {
+		fn := &index.funcs[funcID]
+		if !pred(index.funcInfo(key, fn)) {
+			newFuncIDs[funcID] = -1
+			continue
+		}
+		newFuncIDs[funcID] = int32(len(result.funcs))
+		usedPkgs[fn.pkgID] = true
+		usedFiles[fn.fileID] = true
+		usedDirs[filepath.Dir(index.filenames[fn.fileID])] = true
+
+		newFn := *fn
+		newFn.dataFrom = uint32(len(result.dataPoints))
+		result.dataPoints = append(result.dataPoints, index.dataPoints[fn.dataFrom:fn.dataTo]...)
+		result.numLocalGreater = append(result.numLocalGreater, index.numLocalGreater[fn.dataFrom:fn.dataTo]...)
+		newFn.dataTo = uint32(len(result.dataPoints))
+		result.funcs = append(result.funcs, newFn)
+		keys = append(keys, key)
+	}
+	result.funcTable = newFuncTable(keys)
+	result.callEdges = remapCallEdges(nil, index.callEdges, newFuncIDs)
+	result.callerOrder = buildCallerOrder(result.callEdges, len(result.funcs))
+	result.stackKeys = index.stackKeys
+	result.stackNodes = index.stackNodes
+	result.stacks = index.stacks
+	result.lineStacks = remapLineStacks(index.lineStacks, newFuncIDs)
+
+	var pkgIndex, fileIndex []int32
+	result.pkgStats, pkgIndex = filterGroupStats(index.pkgStats, func(i int) bool {
+		return usedPkgs[i]
+	})
+	result.fileStats, fileIndex = filterGroupStats(index.fileStats, func(i int) bool {
+		return usedFiles[i]
+	})
+	result.dirStats, _ = filterGroupStats(index.dirStats, func(i int) bool {
+		return usedDirs[index.dirStats[i].name]
+	})
+	result.filenames = make([]string, len(result.fileStats))
+	for i, g := range result.fileStats {
+		result.filenames[i] = g.name
+	}
+	for i := range result.funcs {
+		fn := &result.funcs[i]
+		fn.pkgID = uint32(pkgIndex[fn.pkgID])
+		fn.fileID = uint32(fileIndex[fn.fileID])
+	}
+
+	return result
+}
+
+// filterGroupStats returns the groups that are accepted by the keep func.
+// The second result maps the old group indexes to the new ones;
+// the removed groups are mapped to -1.
+func filterGroupStats(groups []groupStats, keep func(i int) bool) ([]groupStats, []int32) {
+	result := make([]groupStats, 0, len(groups))
+	groupIndex := make([]int32, len(groups))
+	for i, g := range groups {
+		if !keep(i) {
+			groupIndex[i] = -1
+			continue
+		}
+		groupIndex[i] = int32(len(result))
+		result = append(result, g)
+	}
+	return result, groupIndex
+}
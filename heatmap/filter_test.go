@@ -0,0 +1,103 @@
+package heatmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilter(t *testing.T) {
+	p := newRandomTestProfile(7, 2000)
+	index := NewIndex(IndexConfig{Threshold: 0.5})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	const pkgPath = "example.com/proj/pkg1"
+	inSubset := func(info FuncInfo) bool {
+		return info.PkgPath == pkgPath
+	}
+	filtered := index.Filter(inSubset)
+
+	if filtered.MemoryUsageApprox() >= index.MemoryUsageApprox() {
+		t.Errorf("filtered index size %d is not less than %d",
+			filtered.MemoryUsageApprox(), index.MemoryUsageApprox())
+	}
+
+	// The remaining funcs should give the same results,
+	// the other funcs should not be present.
+	numFuncs := 0
+	for funcID, key := range index.funcTable.keys {
+		info := index.QueryFunc(key)
+		_, ok := filtered.LookupFunc(key)
+		if ok != inSubset(info) {
+			t.Fatalf("%v: unexpected lookup result %v", key, ok)
+		}
+		if !ok {
+			continue
+		}
+		numFuncs++
+		if diff := cmp.Diff(info, filtered.QueryFunc(key)); diff != "" {
+			t.Fatalf("QueryFunc(%v) mismatch (-want +have):\n%s", key, diff)
+		}
+		fn := &index.funcs[funcID]
+		for line := int(fn.minLine); line <= int(fn.maxLine); line++ {
+			want := index.QueryLine(key, line)
+			have := filtered.QueryLine(key, line)
+			if want != have {
+				t.Fatalf("QueryLine(%v, %d) mismatch (-want +have):\n%s", key, line, cmp.Diff(want, have))
+			}
+		}
+	}
+	if numFuncs == 0 || numFuncs == len(index.funcs) {
+		t.Fatalf("bad test: %d of %d funcs matched", numFuncs, len(index.funcs))
+	}
+
+	for _, g := range filtered.PackageStats() {
+		if g.Name != pkgPath {
+			t.Errorf("unexpected package %s", g.Name)
+		}
+	}
+	for _, g := range filtered.DirStats() {
+		if !strings.HasSuffix(g.Name, pkgPath) {
+			t.Errorf("unexpected dir %s", g.Name)
+		}
+	}
+	filenames := filtered.CollectFilenames()
+	for i, g := range filtered.FileStats() {
+		if !strings.Contains(g.Name, pkgPath+"/") {
+			t.Errorf("unexpected file %s", g.Name)
+		}
+		if filenames[i] != g.Name {
+			t.Errorf("filenames[%d] is %s, file stats name is %s", i, filenames[i], g.Name)
+		}
+	}
+
+	// Relevel of the filtered index ranks the subset alone.
+	// This is equivalent to the original index with the subset global packages.
+	relevelled := filtered.Relevel(IndexConfig{Threshold: 0.5})
+	globalSubset := index.Relevel(IndexConfig{Threshold: 0.5, GlobalPackages: []string{pkgPath}})
+	for _, key := range filtered.funcTable.keys {
+		if diff := cmp.Diff(globalSubset.QueryFunc(key), relevelled.QueryFunc(key)); diff != "" {
+			t.Fatalf("relevelled QueryFunc(%v) mismatch (-want +have):\n%s", key, diff)
+		}
+		h, _ := globalSubset.LookupFunc(key)
+		fn := &globalSubset.funcs[h.funcID]
+		for line := int(fn.minLine); line <= int(fn.maxLine); line++ {
+			want := globalSubset.QueryLine(key, line)
+			have := relevelled.QueryLine(key, line)
+			if want != have {
+				t.Fatalf("relevelled QueryLine(%v, %d) mismatch (-want +have):\n%s", key, line, cmp.Diff(want, have))
+			}
+		}
+	}
+
+	empty := index.Filter(func(FuncInfo) bool { return false })
+	if len(empty.PackageStats()) != 0 || len(empty.CollectFilenames()) != 0 {
+		t.Errorf("empty filter result has some groups")
+	}
+	if err := empty.AddProfile(p); err != ErrIndexNotEmpty {
+		t.Errorf("AddProfile on a filtered index: expected ErrIndexNotEmpty, got %v", err)
+	}
+}
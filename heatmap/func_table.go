@@ -0,0 +1,73 @@
+package heatmap
+
+// funcTable maps the function keys to their IDs.
+//
+// It's an open addressing hash table that is faster than map[Key]uint32:
+// only FuncName and Filename are hashed and the slots are plain uint32 values.
+// The table is immutable after its creation.
+type funcTable struct {
+	// keys are indexed by the func ID.
+	keys []Key
+
+	// slots hold the func ID+1 values; zero means an empty slot.
+	// The slots length is always a power of 2.
+	slots []uint32
+}
+
+func newFuncTable(keys []Key) funcTable {
+	// Keep the load factor at 0.5 or lower, so the probe sequences are short.
+	size := 1
+	for size < 2*len(keys) {
+		size *= 2
+	}
+	t := funcTable{
+		keys:  keys,
+		slots: make([]uint32, size),
+	}
+	mask := uint32(size - 1)
+	for id, key := range keys {
+		i := funcKeyHash(key) & mask
+		for t.slots[i] != 0 {
+			i = (i + 1) & mask
+		}
+		t.slots[i] = uint32(id + 1)
+	}
+	return t
+}
+
+// Len returns the number of keys inside the table.
+func (t *funcTable) Len() int {
+	return len(t.keys)
+}
+
+// Lookup returns the func ID for the key.
+func (t *funcTable) Lookup(key Key) (uint32, bool) {
+	if len(t.slots) == 0 {
+		return 0, false
+	}
+	mask := uint32(len(t.slots) - 1)
+	for i := funcKeyHash(key) & mask; ; i = (i + 1) & mask {
+		slot := t.slots[i]
+		if slot == 0 {
+			return 0, false
+		}
+		if t.keys[slot-1] == key {
+			return slot - 1, true
+		}
+	}
+}
+
+// funcKeyHash is a FNV-1a hash of the key FuncName and Filename.
+// Other key parts rarely make a difference, so they're not hashed.
+func funcKeyHash(key Key) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key.FuncName); i++ {
+		h ^= uint32(key.FuncName[i])
+		h *= 16777619
+	}
+	for i := 0; i < len(key.Filename); i++ {
+		h ^= uint32(key.Filename[i])
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,117 @@
+package heatmap
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFuncTable(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 10, 100, 1000} {
+		keys := make([]Key, n)
+		for i := range keys {
+			keys[i] = Key{
+				TypeName: fmt.Sprintf("T%d", i%3),
+				FuncName: fmt.Sprintf("f%d", i/3),
+				Filename: fmt.Sprintf("file%d.go", i%7),
+				PkgName:  "pkg",
+			}
+		}
+		table := newFuncTable(keys)
+		if table.Len() != n {
+			t.Fatalf("n=%d: Len() returned %d", n, table.Len())
+		}
+		for i, key := range keys {
+			id, ok := table.Lookup(key)
+			if !ok || id != uint32(i) {
+				t.Fatalf("n=%d: Lookup(%v) returned (%d, %v), want (%d, true)", n, key, id, ok, i)
+			}
+			missing := key
+			missing.PkgName = "other"
+			if _, ok := table.Lookup(missing); ok {
+				t.Fatalf("n=%d: Lookup(%v) found a missing key", n, missing)
+			}
+		}
+	}
+}
+
+func TestFuncHandle(t *testing.T) {
+	indexes := []*Index{
+		NewIndex(IndexConfig{Threshold: 1, GlobalPackages: []string{"example.com/proj/pkg1"}}),
+	}
+	if err := indexes[0].AddProfile(newRandomTestProfile(5, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	for _, bench := range benchIndexList {
+		indexes = append(indexes, bench.i)
+	}
+
+	for i, index := range indexes {
+		for _, key := range index.funcTable.keys {
+			h, ok := index.LookupFunc(key)
+			if !ok {
+				t.Fatalf("index%d: LookupFunc(%v) failed", i, key)
+			}
+			if diff := cmp.Diff(index.QueryFunc(key), h.Info()); diff != "" {
+				t.Fatalf("index%d: Info(%v) mismatch (-want +have):\n%s", i, key, diff)
+			}
+			minLine := int(index.funcs[h.funcID].minLine)
+			maxLine := int(index.funcs[h.funcID].maxLine)
+			for line := minLine - 1; line <= maxLine+1; line++ {
+				want := index.QueryLine(key, line)
+				have := h.QueryLine(line)
+				if want != have {
+					t.Fatalf("index%d: QueryLine(%v, %d) mismatch (-want +have):\n%s",
+						i, key, line, cmp.Diff(want, have))
+				}
+			}
+			lines := []int{minLine - 2, minLine, minLine, minLine + 1, (minLine + maxLine) / 2, maxLine, maxLine + 1}
+			sort.Ints(lines)
+			wantLines := make([]LineStats, len(lines))
+			for j, line := range lines {
+				wantLines[j] = index.QueryLine(key, line)
+			}
+			haveLines := make([]LineStats, len(lines))
+			h.QueryLines(lines, haveLines)
+			if !lineStatsEqual(wantLines, haveLines) {
+				t.Fatalf("index%d: handle QueryLines(%v, %v) mismatch (-want +have):\n%s",
+					i, key, lines, cmp.Diff(wantLines, haveLines))
+			}
+			haveLines = make([]LineStats, len(lines)+1)
+			index.QueryLines(key, lines, haveLines)
+			if !lineStatsEqual(wantLines, haveLines[:len(lines)]) {
+				t.Fatalf("index%d: QueryLines(%v, %v) mismatch (-want +have):\n%s",
+					i, key, lines, cmp.Diff(wantLines, haveLines[:len(lines)]))
+			}
+
+			var want, have []LineStats
+			index.QueryLineRange(key, minLine-1, maxLine+1, func(s LineStats) bool {
+				want = append(want, s)
+				return true
+			})
+			h.QueryLineRange(minLine-1, maxLine+1, func(s LineStats) bool {
+				have = append(have, s)
+				return true
+			})
+			if !lineStatsEqual(want, have) {
+				t.Fatalf("index%d: QueryLineRange(%v) mismatch (-want +have):\n%s",
+					i, key, cmp.Diff(want, have))
+			}
+		}
+
+		missing := Key{FuncName: "missing", Filename: "missing.go"}
+		h, ok := index.LookupFunc(missing)
+		if ok {
+			t.Fatalf("index%d: LookupFunc found a missing func", i)
+		}
+		if h.QueryLine(10) != (LineStats{}) || h.Info() != (FuncInfo{}) {
+			t.Fatalf("index%d: non-empty result for a zero handle", i)
+		}
+		h.QueryLineRange(1, 100, func(LineStats) bool {
+			t.Fatalf("index%d: unexpected zero handle callback call", i)
+			return true
+		})
+	}
+}
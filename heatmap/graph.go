@@ -0,0 +1,270 @@
+package heatmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// GraphConfig describes the call graph that is exported by WriteDOT.
+type GraphConfig struct {
+	// Focus selects the functions the graph is centered on.
+	// Only the focus functions, their callers and their callees are included.
+	// Nil value disables the focus, so all functions are candidates.
+	Focus func(info FuncInfo) bool
+
+	// MaxDepth limits the callers and callees chains length around the focus.
+	// Zero value means "no limit".
+	// It's ignored if Focus is nil.
+	MaxDepth int
+
+	// MaxNodes limits the number of graph nodes.
+	// The focus functions are included first, then the hottest other functions.
+	// Zero value implies 80.
+	MaxNodes int
+}
+
+// WriteDOT writes the function call graph in the Graphviz DOT format.
+//
+// The nodes are functions, the edges are the direct calls between them.
+// The index should be built with IndexConfig.CallGraph set,
+// otherwise the graph has no edges.
+// Both nodes and edges are coloured by the function-level heat
+// (see FuncInfo.HeatLevel); an edge uses the callee heat level.
+// The edges width depends on the calls value.
+//
+// The edges values are not limited to the focus stack traces:
+// they're the same as the Index.QueryCallers results.
+//
+// If there are no functions that match the focus, ErrNoFocusFuncs is returned.
+func (index *Index) WriteDOT(w io.Writer, config GraphConfig) error {
+	if config.MaxDepth < 0 {
+		panic("GraphConfig.MaxDepth can't be negative")
+	}
+	if config.MaxNodes < 0 {
+		panic("GraphConfig.MaxNodes can't be negative")
+	}
+	if config.MaxNodes == 0 {
+		config.MaxNodes = 80
+	}
+
+	edges := index.funcCallEdges()
+	nodes, err := index.graphNodes(edges, &config)
+	if err != nil {
+		return err
+	}
+
+	// inGraph maps the func IDs to the node IDs.
+	inGraph := make([]int32, len(index.funcs))
+	for i := range inGraph {
+		inGraph[i] = -1
+	}
+	for i, funcID := range nodes {
+		inGraph[funcID] = int32(i)
+	}
+	maxEdgeValue := int64(0)
+	graphEdges := edges[:0]
+	for _, e := range edges {
+		if inGraph[e.callerID] == -1 || inGraph[e.calleeID] == -1 {
+			continue
+		}
+		graphEdges = append(graphEdges, e)
+		if e.value > maxEdgeValue {
+			maxEdgeValue = e.value
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph \"perf-heatmap\" {\n")
+	buf.WriteString("  node [shape=box style=filled fontname=\"Helvetica\"];\n")
+	buf.WriteString("  edge [fontname=\"Helvetica\"];\n")
+	for i, funcID := range nodes {
+		key := index.funcTable.keys[funcID]
+		fn := &index.funcs[funcID]
+		label := fmt.Sprintf("%s\n%s\ncum %s (%.2f%%)\nflat %s",
+			formatFuncName(key.PkgName, key.TypeName, key.FuncName), key.Filename,
+			formatGraphValue(fn.cumValue), index.shareOfTotal(fn.cumValue),
+			formatGraphValue(fn.flatValue))
+		fmt.Fprintf(&buf, "  n%d [label=%s fillcolor=%q fontcolor=%q];\n",
+			i, strconv.Quote(label), heatColors[fn.level], heatFontColors[fn.level])
+	}
+	for _, e := range graphEdges {
+		penWidth := 1.0
+		if maxEdgeValue != 0 {
+			penWidth += 4 * float64(e.value) / float64(maxEdgeValue)
+		}
+		level := index.funcs[e.calleeID].level
+		fmt.Fprintf(&buf, "  n%d -> n%d [label=%q color=%q penwidth=%.2f];\n",
+			inGraph[e.callerID], inGraph[e.calleeID], formatGraphValue(e.value), heatEdgeColors[level], penWidth)
+	}
+	buf.WriteString("}\n")
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// heatColors are the node fill colors for every heat level.
+var heatColors = [maxHeatLevel + 1]string{
+	"#eeeeee",
+	"#fff3b0",
+	"#ffd166",
+	"#f8961e",
+	"#f3722c",
+	"#d62828",
+}
+
+var heatFontColors = [maxHeatLevel + 1]string{
+	"#000000",
+	"#000000",
+	"#000000",
+	"#000000",
+	"#000000",
+	"#ffffff",
+}
+
+// heatEdgeColors are like heatColors, but the cold edges are
+// a bit darker to be visible on the white background.
+var heatEdgeColors = [maxHeatLevel + 1]string{
+	"#b0b0b0",
+	"#e9c46a",
+	"#ffb627",
+	"#f8961e",
+	"#f3722c",
+	"#d62828",
+}
+
+// funcCallEdge is a callEdge that is aggregated by the caller function.
+type funcCallEdge struct {
+	callerID uint32
+	calleeID uint32
+	value    int64
+}
+
+// funcCallEdges returns the function-level call edges sorted by (callerID, calleeID).
+func (index *Index) funcCallEdges() []funcCallEdge {
+	var edges []funcCallEdge
+	for _, e := range index.callEdges {
+		edges = append(edges, funcCallEdge{
+			callerID: e.callerID,
+			calleeID: e.calleeID,
+			value:    e.value.Nanoseconds(),
+		})
+	}
+	if len(edges) == 0 {
+		return edges
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].callerID != edges[j].callerID {
+			return edges[i].callerID < edges[j].callerID
+		}
+		return edges[i].calleeID < edges[j].calleeID
+	})
+	dst := 0
+	for _, e := range edges[1:] {
+		prev := &edges[dst]
+		if e.callerID == prev.callerID && e.calleeID == prev.calleeID {
+			prev.value += e.value
+			continue
+		}
+		dst++
+		edges[dst] = e
+	}
+	return edges[:dst+1]
+}
+
+// graphNodes returns the func IDs of the graph nodes in ascending order.
+func (index *Index) graphNodes(edges []funcCallEdge, config *GraphConfig) ([]uint32, error) {
+	candidates := make([]uint32, 0, len(index.funcs))
+	isFocus := make([]bool, len(index.funcs))
+	if config.Focus == nil {
+		for funcID := range index.funcs {
+			candidates = append(candidates, uint32(funcID))
+		}
+	} else {
+		var focus []uint32
+		for funcID, key := range index.funcTable.keys {
+			if config.Focus(index.funcInfo(key, &index.funcs[funcID])) {
+				isFocus[funcID] = true
+				focus = append(focus, uint32(funcID))
+			}
+		}
+		if len(focus) == 0 {
+			return nil, ErrNoFocusFuncs
+		}
+		callees := make([][]uint32, len(index.funcs))
+		callers := make([][]uint32, len(index.funcs))
+		for _, e := range edges {
+			callees[e.callerID] = append(callees[e.callerID], e.calleeID)
+			callers[e.calleeID] = append(callers[e.calleeID], e.callerID)
+		}
+		// The callers and callees are collected separately,
+		// so the other callees of the focus callers are not included.
+		reached := make([]bool, len(index.funcs))
+		for _, funcID := range focus {
+			reached[funcID] = true
+		}
+		markReachable(reached, focus, callees, config.MaxDepth)
+		markReachable(reached, focus, callers, config.MaxDepth)
+		for funcID, ok := range reached {
+			if ok {
+				candidates = append(candidates, uint32(funcID))
+			}
+		}
+	}
+
+	if len(candidates) > config.MaxNodes {
+		// The funcs slice order is deterministic, so a stable sort
+		// resolves the ties in a deterministic way too.
+		sort.SliceStable(candidates, func(i, j int) bool {
+			x := candidates[i]
+			y := candidates[j]
+			if isFocus[x] != isFocus[y] {
+				return isFocus[x]
+			}
+			return index.funcs[x].cumValue > index.funcs[y].cumValue
+		})
+		candidates = candidates[:config.MaxNodes]
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i] < candidates[j]
+		})
+	}
+	return candidates, nil
+}
+
+// markReachable marks all funcs that can be reached from the roots
+// using at most maxDepth steps; zero maxDepth means "no limit".
+func markReachable(reached []bool, roots []uint32, next [][]uint32, maxDepth int) {
+	visited := make([]bool, len(reached))
+	queue := append([]uint32(nil), roots...)
+	for _, funcID := range roots {
+		visited[funcID] = true
+	}
+	for depth := 1; len(queue) != 0 && (maxDepth == 0 || depth <= maxDepth); depth++ {
+		var nextQueue []uint32
+		for _, funcID := range queue {
+			for _, id := range next[funcID] {
+				if visited[id] {
+					continue
+				}
+				visited[id] = true
+				reached[id] = true
+				nextQueue = append(nextQueue, id)
+			}
+		}
+		queue = nextQueue
+	}
+}
+
+func (index *Index) shareOfTotal(value int64) float64 {
+	if index.totalValue == 0 {
+		return 0
+	}
+	return 100 * float64(value) / float64(index.totalValue)
+}
+
+func formatGraphValue(value int64) string {
+	return time.Duration(value).Round(10 * time.Microsecond).String()
+}
@@ -0,0 +1,129 @@
+package heatmap
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteDOT(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddStack(70000, "json.go:json.Unmarshal:10", "a.go:main.f:5", "main.go:main.main:20").
+		AddStack(30000, "b.go:main.g:3", "a.go:main.f:5", "main.go:main.main:20").
+		AddStack(10000, "b.go:main.g:3", "a.go:main.f:6", "main.go:main.main:20").
+		AddStack(40000, "json.go:json.Unmarshal:12", "c.go:main.h:7", "main.go:main.main:22").
+		Build()
+	index := NewIndex(IndexConfig{CallGraph: true})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `digraph "perf-heatmap" {
+  node [shape=box style=filled fontname="Helvetica"];
+  edge [fontname="Helvetica"];
+  n0 [label="main.f\na.go\ncum 110µs (73.33%)\nflat 0s" fillcolor="#f3722c" fontcolor="#000000"];
+  n1 [label="main.g\nb.go\ncum 40µs (26.67%)\nflat 40µs" fillcolor="#eeeeee" fontcolor="#000000"];
+  n2 [label="main.h\nc.go\ncum 40µs (26.67%)\nflat 0s" fillcolor="#eeeeee" fontcolor="#000000"];
+  n3 [label="json.Unmarshal\njson.go\ncum 110µs (73.33%)\nflat 110µs" fillcolor="#eeeeee" fontcolor="#000000"];
+  n4 [label="main.main\nmain.go\ncum 150µs (100.00%)\nflat 0s" fillcolor="#d62828" fontcolor="#ffffff"];
+  n0 -> n1 [label="40µs" color="#b0b0b0" penwidth=2.45];
+  n0 -> n3 [label="70µs" color="#b0b0b0" penwidth=3.55];
+  n2 -> n3 [label="40µs" color="#b0b0b0" penwidth=2.45];
+  n4 -> n0 [label="110µs" color="#f3722c" penwidth=5.00];
+  n4 -> n2 [label="40µs" color="#b0b0b0" penwidth=2.45];
+}
+`
+	var buf bytes.Buffer
+	if err := index.WriteDOT(&buf, GraphConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("output mismatch (-want +have):\n%s", diff)
+	}
+
+	focusOn := func(id string) func(FuncInfo) bool {
+		return func(info FuncInfo) bool {
+			return info.PkgName+"."+info.ID == id
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config GraphConfig
+		nodes  []string
+		edges  []string
+	}{
+		{
+			name:   "focus f",
+			config: GraphConfig{Focus: focusOn("main.f")},
+			nodes:  []string{"json.Unmarshal", "main.f", "main.g", "main.main"},
+			edges:  []string{"main.f -> json.Unmarshal", "main.f -> main.g", "main.main -> main.f"},
+		},
+		{
+			name:   "focus Unmarshal depth 1",
+			config: GraphConfig{Focus: focusOn("json.Unmarshal"), MaxDepth: 1},
+			nodes:  []string{"json.Unmarshal", "main.f", "main.h"},
+			edges:  []string{"main.f -> json.Unmarshal", "main.h -> json.Unmarshal"},
+		},
+		{
+			name:   "focus Unmarshal",
+			config: GraphConfig{Focus: focusOn("json.Unmarshal")},
+			nodes:  []string{"json.Unmarshal", "main.f", "main.h", "main.main"},
+			edges: []string{
+				"main.f -> json.Unmarshal",
+				"main.h -> json.Unmarshal",
+				"main.main -> main.f",
+				"main.main -> main.h",
+			},
+		},
+		{
+			name:   "focus h max nodes 2",
+			config: GraphConfig{Focus: focusOn("main.h"), MaxNodes: 2},
+			nodes:  []string{"main.h", "main.main"},
+			edges:  []string{"main.main -> main.h"},
+		},
+		{
+			name:   "max nodes 2",
+			config: GraphConfig{MaxNodes: 2},
+			nodes:  []string{"main.f", "main.main"},
+			edges:  []string{"main.main -> main.f"},
+		},
+	}
+
+	nodeRE := regexp.MustCompile(`(?m)^  (n\d+) \[label="([^\\]+)\\n`)
+	edgeRE := regexp.MustCompile(`(?m)^  (n\d+) -> (n\d+) `)
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := index.WriteDOT(&buf, test.config); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		out := buf.String()
+		names := map[string]string{}
+		var nodes, edges []string
+		for _, m := range nodeRE.FindAllStringSubmatch(out, -1) {
+			names[m[1]] = m[2]
+			nodes = append(nodes, m[2])
+		}
+		for _, m := range edgeRE.FindAllStringSubmatch(out, -1) {
+			edges = append(edges, names[m[1]]+" -> "+names[m[2]])
+		}
+		sort.Strings(nodes)
+		sort.Strings(edges)
+		if diff := cmp.Diff(test.nodes, nodes); diff != "" {
+			t.Errorf("%s: nodes mismatch (-want +have):\n%s", test.name, diff)
+		}
+		if diff := cmp.Diff(test.edges, edges); diff != "" {
+			t.Errorf("%s: edges mismatch (-want +have):\n%s\n%s", test.name, diff, strings.TrimSpace(out))
+		}
+	}
+
+	err := index.WriteDOT(&buf, GraphConfig{Focus: focusOn("main.missing")})
+	if !errors.Is(err, ErrNoFocusFuncs) {
+		t.Errorf("missing focus: expected ErrNoFocusFuncs, got %v", err)
+	}
+}
@@ -1,7 +1,10 @@
 package heatmap
 
 import (
+	"context"
+	"runtime"
 	"sort"
+	"time"
 
 	"github.com/google/pprof/profile"
 )
@@ -25,7 +28,8 @@ type Key struct {
 
 // Index represents a parsed profile that can run heatmap queries efficiently.
 type Index struct {
-	funcIDByKey map[Key]uint32
+	// funcTable maps the keys to the funcs slice indexes.
+	funcTable funcTable
 
 	// A combined storage for all data points.
 	// To get func-specificic data points, do the slicing like
@@ -35,11 +39,56 @@ type Index struct {
 	// in ascending order, so window[0].line <= window[1].line.
 	dataPoints []dataPoint
 
+	// numLocalGreater holds a number of func data points with
+	// a greater value for every data point; it's used for the LocalRank.
+	// It's indexed like the dataPoints.
+	numLocalGreater []uint32
+
 	funcs []funcIndex
 
 	// filenames is a list of full file names.
 	filenames []string
 
+	// globalValues holds all data point cumulative values
+	// sorted in descending order. It's used to compute the global ranks.
+	globalValues []durationValue
+
+	// totalValue is a sum of all profile sample values in nanoseconds.
+	totalValue int64
+
+	metadata Metadata
+
+	// valuePeriod is used to derive the data point samples number
+	// from its value, see computeValuePeriod.
+	valuePeriod int64
+
+	// callEdges are the direct calls from the lines to the functions.
+	// They're sorted by (callerID, line, calleeID).
+	callEdges []callEdge
+
+	// callerOrder holds the callEdges indexes sorted by calleeID.
+	callerOrder []uint32
+
+	// Stack traces are stored as a prefix tree.
+	// The tree nodes refer to the stackKeys, so the index
+	// can drop the functions without rebuilding the tree.
+	// See stackNode comment for more details.
+	stackKeys  []Key
+	stackNodes []stackNode
+	stacks     []stackRecord
+
+	// lineStacks bind the stacks to the lines.
+	// They're sorted by (funcID, line, stackID);
+	// the stacks are sorted by value, so the hottest
+	// line stack traces come first.
+	lineStacks []lineStack
+
+	// Aggregated stats for packages, directories and files.
+	// Every slice is sorted by the group name.
+	pkgStats  []groupStats
+	dirStats  []groupStats
+	fileStats []groupStats
+
 	config IndexConfig
 }
 
@@ -59,11 +108,160 @@ type IndexConfig struct {
 	// Values in between get appropriate levels based on their distance.
 	// Samples below the threshold may still end up populating the index,
 	// but their heat level is guaranteed to be 0.
+	// Use PruneCold to drop them.
 	//
 	// There could be implementation details for edge cases.
 	// For example, for files with a low number of samples we may
 	// take all of them.
 	Threshold float64
+
+	// ThresholdOverrides specify custom thresholds for the matching functions.
+	// They affect the local heat levels (including the flat ones),
+	// the global ranking always uses the Threshold value.
+	//
+	// This is useful when some packages have a few very long functions
+	// while others have a lot of tiny ones.
+	//
+	// If several overrides match the function, the one with
+	// the longest matching prefix is used.
+	ThresholdOverrides []ThresholdOverride
+
+	// GlobalPackages limits the global heat levels ranking to the given packages.
+	// Every entry is a package import path prefix: "example.com/foo" matches
+	// both "example.com/foo" and "example.com/foo/bar" packages.
+	// The typical use case is to list only the main module path, so
+	// runtime and stdlib lines don't take the top global levels.
+	// The main package functions have the "main" package path in profiles,
+	// so "main" should be listed along with the module path.
+	//
+	// Data points from other packages are still indexed and
+	// have local heat levels, but their global levels are always 0.
+	//
+	// An empty list means "all packages".
+	GlobalPackages []string
+
+	// LeafPackages enables the runtime cost attribution mode.
+	// Flat values of frames that belong to these packages are charged
+	// to the first caller frame from other packages.
+	// For example, with "runtime" listed here, the time spent inside
+	// runtime.mallocgc that was called from append(...) would go
+	// to the line that contains that append.
+	//
+	// Entries follow the same prefix matching rules as GlobalPackages.
+	// A typical list looks like {"runtime", "internal", "reflect"}.
+	//
+	// This option is applied while adding a profile, so Relevel
+	// keeps the value that was used to build the original index.
+	LeafPackages []string
+
+	// MinConfidence is a minimal LineStats.Confidence value that
+	// is required for a line to have non-zero heat levels.
+	// Lines that are based on too few samples are demoted to level 0.
+	//
+	// MinConfidence should be in the [0, 1.0) range.
+	// Zero value disables this filtering.
+	MinConfidence float64
+
+	// MinShare is an absolute cutoff for the hot lines.
+	// Lines with a value that is less than MinShare of the
+	// total profile samples value are always cold (level 0).
+	// Flat heat levels are checked against the line flat value.
+	//
+	// Unlike Threshold, it makes it possible for the profile to have
+	// no hot lines at all, so idle profiles don't light up.
+	//
+	// MinShare should be in the [0, 1.0) range.
+	// Zero value disables this filtering.
+	MinShare float64
+
+	// MinValue is like MinShare, but the cutoff is a fixed duration.
+	// If both are set, the bigger cutoff is used.
+	MinValue time.Duration
+
+	// StacksPerLine is a max number of the hottest stack traces
+	// that are kept for every line, see Index.QueryStacks.
+	// Zero value disables the stack traces recording.
+	//
+	// This option is applied while adding a profile, so Relevel
+	// keeps the value that was used to build the original index.
+	StacksPerLine int
+
+	// CallGraph enables the direct calls recording,
+	// see Index.QueryCallees, Index.QueryCallers and Index.WriteDOT.
+	// It makes the index build slower and the index itself bigger.
+	//
+	// This option is applied while adding a profile, so Relevel
+	// keeps the value that was used to build the original index.
+	CallGraph bool
+
+	// PruneCold enables the cold data points removal.
+	// Data points that have all heat levels equal to 0 are dropped
+	// after the levels are assigned, along with the functions
+	// that are left without data points.
+	// This makes the index much smaller for the typical thresholds.
+	//
+	// Queries for the removed lines and functions return zero values.
+	// LineStats.LocalRank and LineStats.GlobalRank are computed
+	// among the remaining data points.
+	// Relevel of a pruned index only has the remaining data points to rank.
+	PruneCold bool
+
+	// Parallelism is a max number of goroutines that are used
+	// to build the index. The result doesn't depend on this value.
+	//
+	// The aggregated data is sharded by functions between the goroutines,
+	// so the extra goroutines don't make the build use much more memory.
+	//
+	// Zero value implies runtime.GOMAXPROCS(0).
+	// A value of 1 makes the index building sequential.
+	Parallelism int
+}
+
+// ThresholdOverride is a IndexConfig.Threshold value that
+// is used for a subset of functions.
+//
+// At least one of PkgPath and FilePrefix should be non-empty.
+// If both are set, the override matches if any of them matches.
+type ThresholdOverride struct {
+	// PkgPath is a package import path prefix.
+	// It follows the IndexConfig.GlobalPackages matching rules.
+	PkgPath string
+
+	// FilePrefix is a full file path prefix, like "/home/gopher/proj/internal/".
+	FilePrefix string
+
+	// Threshold should be in the (0, 1.0] range.
+	Threshold float64
+}
+
+// Metadata describes the profile that was used to build the index.
+type Metadata struct {
+	// SampleType and SampleUnit describe the indexed sample values,
+	// like "cpu" and "nanoseconds".
+	SampleType string
+	SampleUnit string
+
+	// PeriodType, PeriodUnit and Period describe the profile sampling period.
+	// For CPU profiles it's usually "cpu", "nanoseconds" and 10000000 (10ms).
+	PeriodType string
+	PeriodUnit string
+	Period     int64
+
+	// Duration is a profile collection duration.
+	Duration time.Duration
+
+	// TimeCollected is a moment when the profile was collected.
+	// It's a zero time if profile doesn't have this information.
+	TimeCollected time.Time
+
+	// Comments are free-form profile annotations.
+	Comments []string
+
+	// MainBinary is a main binary file name.
+	MainBinary string
+
+	// BuildID is a main binary build ID.
+	BuildID string
 }
 
 // FuncInfo contains some aggregated function info.
@@ -72,23 +270,80 @@ type FuncInfo struct {
 
 	PkgName string
 
+	// PkgPath is a function package import path.
+	PkgPath string
+
 	Filename string
 
+	// Value is the aggregated cumulative value for this function.
+	// Every sample is counted only once, so recursion doesn't inflate it.
+	Value int64
+
+	// FlatValue is a sum of all function lines "own" samples.
+	FlatValue int64
+
+	// HeatLevel is a function-level heat score.
+	// It's computed by ranking all index functions by their Value,
+	// so a big function is not hot just because it has a few hot lines.
+	// The ranking follows the same rules as LineStats.GlobalHeatLevel.
+	HeatLevel int
+
+	// FlatHeatLevel is like HeatLevel, but functions are ranked by FlatValue.
+	FlatHeatLevel int
+
+	// MaxHeatLevel is a max LineStats.HeatLevel among the function lines.
 	MaxHeatLevel int
 
+	// MaxGlobalHeatLevel is a max LineStats.GlobalHeatLevel among the function lines.
 	MaxGlobalHeatLevel int
+
+	// MaxFlatHeatLevel is a max LineStats.FlatHeatLevel among the function lines.
+	MaxFlatHeatLevel int
+
+	// MaxFlatGlobalHeatLevel is a max LineStats.FlatGlobalHeatLevel among the function lines.
+	MaxFlatGlobalHeatLevel int
 }
 
 // NewIndex creates an empty heatmap index.
 // Use AddProfile method to populate it.
 func NewIndex(config IndexConfig) *Index {
+	return &Index{config: normalizeConfig(config)}
+}
+
+func normalizeConfig(config IndexConfig) IndexConfig {
 	if config.Threshold == 0 {
 		config.Threshold = 0.5
 	}
 	if config.Threshold <= 0 || config.Threshold > 1 {
 		panic("IndexConfig.Threshold should be in (0, 1.0] range")
 	}
-	return &Index{config: config}
+	for _, o := range config.ThresholdOverrides {
+		if o.PkgPath == "" && o.FilePrefix == "" {
+			panic("ThresholdOverride should have non-empty PkgPath or FilePrefix")
+		}
+		if o.Threshold <= 0 || o.Threshold > 1 {
+			panic("ThresholdOverride.Threshold should be in (0, 1.0] range")
+		}
+	}
+	if config.MinConfidence < 0 || config.MinConfidence >= 1 {
+		panic("IndexConfig.MinConfidence should be in [0, 1.0) range")
+	}
+	if config.MinShare < 0 || config.MinShare >= 1 {
+		panic("IndexConfig.MinShare should be in [0, 1.0) range")
+	}
+	if config.MinValue < 0 {
+		panic("IndexConfig.MinValue can't be negative")
+	}
+	if config.StacksPerLine < 0 {
+		panic("IndexConfig.StacksPerLine can't be negative")
+	}
+	if config.Parallelism < 0 {
+		panic("IndexConfig.Parallelism can't be negative")
+	}
+	if config.Parallelism == 0 {
+		config.Parallelism = runtime.GOMAXPROCS(0)
+	}
+	return config
 }
 
 // AddProfile adds samples from the profile to the index.
@@ -98,13 +353,72 @@ func NewIndex(config IndexConfig) *Index {
 //
 // This operation can take a long time.
 func (index *Index) AddProfile(p *profile.Profile) error {
-	return addProfile(index, p)
+	_, err := addProfile(context.Background(), index, p, nil)
+	return err
+}
+
+// AddProfileContext is like AddProfile, but it can be cancelled
+// via the context and it reports the progress through the callback.
+// The progress callback can be nil.
+//
+// The cancellation is checked during the samples aggregation and sorting,
+// including the data points sorting for the heat levels computation.
+// If the context is cancelled, its error is returned and the index is left unmodified.
+func (index *Index) AddProfileContext(ctx context.Context, p *profile.Profile, progress ProgressFunc) error {
+	_, err := addProfile(ctx, index, p, progress)
+	return err
+}
+
+// AddProfileWithReport is like AddProfile, but it also returns
+// the diagnostics report that describes the dropped samples and frames.
+//
+// The report is returned even if error is not nil; in this case
+// it only covers the samples processed before the error occurred.
+func (index *Index) AddProfileWithReport(p *profile.Profile) (*Report, error) {
+	return addProfile(context.Background(), index, p, nil)
+}
+
+// Relevel creates a new index that has the same profile data,
+// but the heat levels are recomputed according to the new config.
+//
+// This is much cheaper than building a new index from the profile.
+// The new index shares the immutable parts with the original one,
+// but data points are copied as they carry the heat levels.
+func (index *Index) Relevel(config IndexConfig) *Index {
+	return relevel(index, normalizeConfig(config))
 }
 
 func (index *Index) CollectFilenames() []string {
 	return index.filenames
 }
 
+// PackageStats returns the profile data aggregated by packages.
+// Packages are identified by their import paths.
+// The results are sorted by the package path.
+func (index *Index) PackageStats() []AggregateStats {
+	return convertGroupStats(index.pkgStats)
+}
+
+// DirStats returns the profile data aggregated by directories.
+// The results are sorted by the directory path.
+func (index *Index) DirStats() []AggregateStats {
+	return convertGroupStats(index.dirStats)
+}
+
+// FileStats returns the profile data aggregated by files.
+// The results are sorted by the file path.
+func (index *Index) FileStats() []AggregateStats {
+	return convertGroupStats(index.fileStats)
+}
+
+// Metadata returns the info about the profile that was used to build this index.
+// It returns a zero value if no profile was added yet.
+func (index *Index) Metadata() Metadata {
+	metadata := index.metadata
+	metadata.Comments = append([]string(nil), metadata.Comments...)
+	return metadata
+}
+
 // MemoryUsageApprox returns the approximate size of this index in bytes.
 // Note: it implies 64-bit architecture.
 func (index *Index) MemoryUsageApprox() int {
@@ -121,6 +435,29 @@ type LineStats struct {
 	// FlatValue, unlike Value, includes only "own" samples for this line.
 	FlatValue int64
 
+	// NumSamples is the number of profile samples that contributed to this line.
+	// A sample is counted once even if it hits the line several times,
+	// like in recursive calls.
+	// Lines with only a few samples may have unreliable heat levels.
+	// This counter saturates at 65535.
+	NumSamples int
+
+	// Confidence is a [0, 1] estimate of how statistically meaningful
+	// the Value is, given the number of samples it's based on.
+	// It's derived from the 95% Poisson confidence interval
+	// of the samples number: 1 - (interval half-width / samples).
+	//
+	// Usually, the samples number is NumSamples. But if the profile
+	// samples count doesn't match its total value and sampling period
+	// (like in the scaled profiles), the samples number is derived
+	// from the Value and the sampling period instead.
+	Confidence float64
+
+	// ValueLow and ValueHigh form a 95% confidence interval for the Value.
+	// It's the samples number interval multiplied by the average sample value.
+	ValueLow  int64
+	ValueHigh int64
+
 	// HeatLevel is a file-local heat score according to the index settings.
 	//
 	// 0 means "cold": this line either didn't appear in the benchmark,
@@ -137,6 +474,30 @@ type LineStats struct {
 	// GlobalHeatLevel is based on the aggregated top among all files.
 	GlobalHeatLevel int
 
+	// FlatHeatLevel is like HeatLevel, but it's based on FlatValue.
+	// Lines that only call the hot functions without doing
+	// the work themselves don't get high flat levels.
+	//
+	// Only lines with non-zero FlatValue participate in the flat ranking,
+	// so the threshold is applied to that subset of lines.
+	FlatHeatLevel int
+
+	// FlatGlobalHeatLevel is like GlobalHeatLevel, but it's based on FlatValue.
+	FlatGlobalHeatLevel int
+
+	// LocalRank is a continuous version of HeatLevel.
+	// It's a position of this line among the function lines
+	// ranked by Value, mapped to (0, 1] range: 1 is the hottest line.
+	//
+	// Lines with equal values get equal ranks.
+	LocalRank float64
+
+	// GlobalRank is like LocalRank, but it ranks the line among all index lines.
+	GlobalRank float64
+
+	// ShareOfTotal is a Value to the total profile samples value ratio.
+	ShareOfTotal float64
+
 	// Func is a containing function info.
 	// Note: it will be nil for Query functions.
 	Func *FuncInfo
@@ -144,32 +505,113 @@ type LineStats struct {
 
 // Inspect visits all data points using the provided callback.
 //
-// The data points traversal order is not deterministic, but
-// it's guaranteed to walk func-associated data points in
+// Functions are visited in the full filename order.
+// It's guaranteed to walk func-associated data points in
 // source line sorted order.
 func (index *Index) Inspect(callback func(LineStats)) {
 	var funcInfo FuncInfo
-	for key, funcID := range index.funcIDByKey {
+	for funcID, key := range index.funcTable.keys {
 		fn := &index.funcs[funcID]
-		funcInfo.ID = formatFuncName("", key.TypeName, key.FuncName)
-		funcInfo.PkgName = key.PkgName
-		funcInfo.MaxHeatLevel = int(fn.maxLocalLevel)
-		funcInfo.MaxGlobalHeatLevel = int(fn.maxGlobalLevel)
-		funcInfo.Filename = index.filenames[fn.fileID]
+		funcInfo = index.funcInfo(key, fn)
 		data := index.dataPoints[fn.dataFrom:fn.dataTo]
-		for _, pt := range data {
-			callback(LineStats{
-				LineNum:         int(pt.line),
-				Value:           pt.cumValue.Nanoseconds(),
-				FlatValue:       pt.flatValue.Nanoseconds(),
-				HeatLevel:       pt.flags.GetLocalLevel(),
-				GlobalHeatLevel: pt.flags.GetGlobalLevel(),
-				Func:            &funcInfo,
-			})
+		for i := range data {
+			stats := index.lineStats(fn, i)
+			stats.Func = &funcInfo
+			callback(stats)
 		}
 	}
 }
 
+// QueryFunc returns the aggregated function info.
+// If there is no such function in the index, a zero value is returned.
+func (index *Index) QueryFunc(key Key) FuncInfo {
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		return FuncInfo{}
+	}
+	return index.funcInfo(key, &index.funcs[funcID])
+}
+
+// FuncHandle is a resolved function key.
+// Its queries don't involve the key lookup, so it's faster to use
+// a handle when the same function is queried several times.
+//
+// A zero value handle is valid; its queries return zero values.
+type FuncHandle struct {
+	index  *Index
+	funcID uint32
+}
+
+// LookupFunc resolves the key to a function handle.
+// If there is no such function in the index, false is returned.
+func (index *Index) LookupFunc(key Key) (FuncHandle, bool) {
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		return FuncHandle{}, false
+	}
+	return FuncHandle{index: index, funcID: funcID}, true
+}
+
+// Info is like Index.QueryFunc.
+func (h FuncHandle) Info() FuncInfo {
+	if h.index == nil {
+		return FuncInfo{}
+	}
+	return h.index.funcInfo(h.index.funcTable.keys[h.funcID], &h.index.funcs[h.funcID])
+}
+
+// QueryLine is like Index.QueryLine.
+func (h FuncHandle) QueryLine(line int) LineStats {
+	if h.index == nil {
+		return LineStats{}
+	}
+	return h.index.queryFuncLine(&h.index.funcs[h.funcID], line)
+}
+
+// QueryLines is like Index.QueryLines.
+func (h FuncHandle) QueryLines(lines []int, out []LineStats) {
+	if len(out) < len(lines) {
+		panic("len(out) < len(lines)")
+	}
+	if h.index == nil {
+		clearLineStats(out[:len(lines)])
+		return
+	}
+	h.index.queryFuncLines(&h.index.funcs[h.funcID], lines, out)
+}
+
+// QueryLineRange is like Index.QueryLineRange.
+func (h FuncHandle) QueryLineRange(lineFrom, lineTo int, callback func(stats LineStats) bool) {
+	if lineFrom == lineTo {
+		callback(h.QueryLine(lineFrom))
+		return
+	}
+	if lineFrom > lineTo {
+		panic("lineFrom > lineTo")
+	}
+	if h.index == nil {
+		return
+	}
+	h.index.queryFuncLineRange(&h.index.funcs[h.funcID], lineFrom, lineTo, callback)
+}
+
+func (index *Index) funcInfo(key Key, fn *funcIndex) FuncInfo {
+	return FuncInfo{
+		ID:                     formatFuncName("", key.TypeName, key.FuncName),
+		PkgName:                key.PkgName,
+		PkgPath:                index.pkgStats[fn.pkgID].name,
+		Filename:               index.filenames[fn.fileID],
+		Value:                  fn.cumValue,
+		FlatValue:              fn.flatValue,
+		HeatLevel:              int(fn.level),
+		FlatHeatLevel:          int(fn.flatLevel),
+		MaxHeatLevel:           int(fn.maxLocalLevel),
+		MaxGlobalHeatLevel:     int(fn.maxGlobalLevel),
+		MaxFlatHeatLevel:       int(fn.maxLocalFlatLevel),
+		MaxFlatGlobalHeatLevel: int(fn.maxGlobalFlatLevel),
+	}
+}
+
 // QueryLineRange scans the file data points that are located in [lineFrom, lineTo] range.
 // callback is called for every matching data point.
 // Returning false from the callback causes the iteration to stop early.
@@ -182,12 +624,69 @@ func (index *Index) QueryLineRange(key Key, lineFrom, lineTo int, callback func(
 }
 
 func (index *Index) QueryLine(key Key, line int) LineStats {
-	var result LineStats
-	funcID, ok := index.funcIDByKey[key]
+	funcID, ok := index.funcTable.Lookup(key)
 	if !ok {
-		return result
+		return LineStats{}
 	}
-	fn := index.funcs[funcID]
+	return index.queryFuncLine(&index.funcs[funcID], line)
+}
+
+// QueryLines is a batch version of QueryLine.
+// The stats for lines[i] are written to out[i];
+// lines without data points get a zero value.
+//
+// The lines are expected to be sorted in ascending order.
+// The out slice should be at least as long as lines.
+//
+// It's faster than calling QueryLine for every line as the key is resolved once
+// and the function data points are scanned only once.
+func (index *Index) QueryLines(key Key, lines []int, out []LineStats) {
+	if len(out) < len(lines) {
+		panic("len(out) < len(lines)")
+	}
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok {
+		clearLineStats(out[:len(lines)])
+		return
+	}
+	index.queryFuncLines(&index.funcs[funcID], lines, out)
+}
+
+func (index *Index) queryFuncLines(fn *funcIndex, lines []int, out []LineStats) {
+	if len(lines) == 0 {
+		return
+	}
+
+	data := index.dataPoints[fn.dataFrom:fn.dataTo]
+
+	// Skip the data points that are located before the first requested line.
+	j := 0
+	if lines[0] > int(fn.minLine) {
+		j = sort.Search(len(data), func(i int) bool {
+			return int(data[i].line) >= lines[0]
+		})
+	}
+
+	for i, line := range lines {
+		for j < len(data) && int(data[j].line) < line {
+			j++
+		}
+		if j < len(data) && int(data[j].line) == line {
+			out[i] = index.lineStats(fn, j)
+		} else {
+			out[i] = LineStats{}
+		}
+	}
+}
+
+func clearLineStats(stats []LineStats) {
+	for i := range stats {
+		stats[i] = LineStats{}
+	}
+}
+
+func (index *Index) queryFuncLine(fn *funcIndex, line int) LineStats {
+	var result LineStats
 
 	// A quick range check to avoid the search.
 	if line < int(fn.minLine) || line > int(fn.maxLine) {
@@ -198,9 +697,8 @@ func (index *Index) QueryLine(key Key, line int) LineStats {
 	if len(data) <= 4 {
 		// Short data slice, use a linear search.
 		for i := range data {
-			pt := &data[i]
-			if pt.line == uint32(line) {
-				result = pt.Stats()
+			if data[i].line == uint32(line) {
+				result = index.lineStats(fn, i)
 				break
 			}
 		}
@@ -210,24 +708,55 @@ func (index *Index) QueryLine(key Key, line int) LineStats {
 			return data[i].line >= uint32(line)
 		})
 		if i < len(data) && data[i].line == uint32(line) {
-			result = data[i].Stats()
+			result = index.lineStats(fn, i)
 		}
 	}
 
 	return result
 }
 
+// lineStats converts the fn data point into LineStats.
+// i is a data point index inside the fn data window.
+func (index *Index) lineStats(fn *funcIndex, i int) (stats LineStats) {
+	id := fn.dataFrom + uint32(i)
+	pt := &index.dataPoints[id]
+	pt.setStats(&stats)
+	numPoints := fn.NumPoints()
+	stats.LocalRank = float64(numPoints-int(index.numLocalGreater[id])) / float64(numPoints)
+	if fn.inGlobalRanking {
+		stats.GlobalRank = index.globalRank(pt)
+	}
+	setValueStats(&stats, pt, index.totalValue, index.valuePeriod)
+	return stats
+}
+
+// setValueStats fills the LineStats fields that depend on the profile totals.
+func setValueStats(stats *LineStats, pt *dataPoint, totalValue, valuePeriod int64) {
+	if totalValue != 0 {
+		stats.ShareOfTotal = float64(stats.Value) / float64(totalValue)
+	}
+	if n := expectedSamples(pt, valuePeriod); n != 0 {
+		low, high := sampleInterval(n)
+		stats.Confidence = intervalConfidence(n, high)
+		// An average sample value is Value/n.
+		stats.ValueLow = int64(low * float64(stats.Value) / n)
+		stats.ValueHigh = int64(high * float64(stats.Value) / n)
+	}
+}
+
 func (index *Index) queryLineRange(key Key, lineFrom, lineTo int, callback func(stats LineStats) bool) {
 	if lineFrom > lineTo {
 		panic("lineFrom > lineTo")
 	}
 
-	funcID, ok := index.funcIDByKey[key]
+	funcID, ok := index.funcTable.Lookup(key)
 	if !ok {
 		return
 	}
-	fn := index.funcs[funcID]
+	index.queryFuncLineRange(&index.funcs[funcID], lineFrom, lineTo, callback)
+}
 
+func (index *Index) queryFuncLineRange(fn *funcIndex, lineFrom, lineTo int, callback func(stats LineStats) bool) {
 	// A quick range check to avoid the search.
 	if int(fn.maxLine) < lineFrom || int(fn.minLine) > lineTo {
 		return
@@ -250,15 +779,13 @@ func (index *Index) queryLineRange(key Key, lineFrom, lineTo int, callback func(
 		return data[i].line >= uint32(lineFrom)
 	})
 	if i < len(data) && data[i].line >= uint32(lineFrom) && data[i].line <= uint32(lineTo) {
-		pt := &data[i]
 		// i is a first matching entry, the leftmost one.
-		if !callback(pt.Stats()) {
+		if !callback(index.lineStats(fn, i)) {
 			return
 		}
 		// All data points until lineTo are matched too.
 		for j := i + 1; j < len(data) && data[j].line <= uint32(lineTo); j++ {
-			pt := &data[j]
-			if !callback(pt.Stats()) {
+			if !callback(index.lineStats(fn, j)) {
 				return
 			}
 		}
@@ -0,0 +1,485 @@
+package heatmap
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+func relevel(index *Index, config IndexConfig) *Index {
+	result := *index
+	result.config = config
+	result.config.LeafPackages = index.config.LeafPackages
+	result.config.StacksPerLine = index.config.StacksPerLine
+	result.config.CallGraph = index.config.CallGraph
+	result.dataPoints = make([]dataPoint, len(index.dataPoints))
+	copy(result.dataPoints, index.dataPoints)
+	for i := range result.dataPoints {
+		result.dataPoints[i].flags.ClearLevels()
+	}
+	result.funcs = make([]funcIndex, len(index.funcs))
+	copy(result.funcs, index.funcs)
+	result.pkgStats = copyGroupStats(index.pkgStats)
+	result.dirStats = copyGroupStats(index.dirStats)
+	result.fileStats = copyGroupStats(index.fileStats)
+	// Relevel can't be cancelled, so computeLevels never fails here.
+	_ = computeLevels(&result, &progressTracker{ctx: context.Background()})
+	return &result
+}
+
+func copyGroupStats(groups []groupStats) []groupStats {
+	result := make([]groupStats, len(groups))
+	copy(result, groups)
+	return result
+}
+
+// funcsPerBatch is a number of functions that are handled
+// by a goroutine at once during the local levels computation.
+const funcsPerBatch = 64
+
+// computeLevels assigns the heat levels to all index data points,
+// functions and groups according to the index config.
+//
+// The data points are expected to have no levels assigned yet.
+// After this call, all func-specific data point windows are sorted by line.
+//
+// The cancellation is checked between the sorting steps; in case of
+// the cancellation, the index is left in a partially modified state.
+func computeLevels(index *Index, progress *progressTracker) error {
+	config := &index.config
+	allPoints := index.dataPoints
+
+	// Every point is sorted once by the local ranking
+	// and twice by the global ones.
+	if err := progress.Start(PhaseLevels, 3*len(allPoints)); err != nil {
+		return err
+	}
+
+	// Step 1: compute the local heat levels and ranks.
+	// Func data windows don't overlap, so they're handled in parallel.
+	index.numLocalGreater = make([]uint32, len(allPoints))
+	failed := int32(0)
+	parallelFor(len(index.funcs), funcsPerBatch, config.Parallelism, func(_, from, to int) {
+		if atomic.LoadInt32(&failed) != 0 {
+			return
+		}
+		var values []durationValue
+		numPoints := 0
+		for i := from; i < to; i++ {
+			fn := &index.funcs[i]
+			threshold := index.funcThreshold(fn)
+			funcData := allPoints[fn.dataFrom:fn.dataTo]
+			sort.Slice(funcData, func(i, j int) bool {
+				return pointGreater(funcData[i], funcData[j])
+			})
+			assignLevels(len(funcData), threshold, func(i, level int) {
+				funcData[i].flags.SetLocalLevel(level)
+			})
+			// Keep the sorted values to compute the ranks
+			// after the points are sorted by line.
+			values = values[:0]
+			for _, pt := range funcData {
+				values = append(values, pt.cumValue)
+			}
+			// Compute local flat heat levels.
+			// Only the points with non-zero flat value are ranked.
+			sort.Slice(funcData, func(i, j int) bool {
+				return flatPointGreater(funcData[i], funcData[j])
+			})
+			assignLevels(numFlatPoints(funcData), threshold, func(i, level int) {
+				funcData[i].flags.SetLocalFlatLevel(level)
+			})
+			// A final sort: by line.
+			sort.Slice(funcData, func(i, j int) bool {
+				return funcData[i].line < funcData[j].line
+			})
+			setNumLocalGreater(index.numLocalGreater[fn.dataFrom:fn.dataTo], funcData, values)
+			numPoints += len(funcData)
+		}
+		if err := progress.Step(numPoints); err != nil {
+			atomic.StoreInt32(&failed, 1)
+		}
+	})
+	if err := progress.ctx.Err(); err != nil {
+		return err
+	}
+
+	// Step 2: compute the global heat levels.
+	// Only the functions from the GlobalPackages participate in this ranking.
+	valueOrder := make([]uint32, 0, len(allPoints))
+	for i := range index.funcs {
+		fn := &index.funcs[i]
+		fn.inGlobalRanking = len(config.GlobalPackages) == 0 ||
+			matchPkgPath(config.GlobalPackages, index.pkgStats[fn.pkgID].name)
+		if !fn.inGlobalRanking {
+			continue
+		}
+		for id := fn.dataFrom; id < fn.dataTo; id++ {
+			valueOrder = append(valueOrder, id)
+		}
+	}
+	sort.Slice(valueOrder, func(i, j int) bool {
+		x := allPoints[valueOrder[i]]
+		y := allPoints[valueOrder[j]]
+		return pointGreater(x, y)
+	})
+	assignLevels(len(valueOrder), config.Threshold, func(i, level int) {
+		allPoints[valueOrder[i]].flags.SetGlobalLevel(level)
+	})
+	index.globalValues = make([]durationValue, len(valueOrder))
+	for i, id := range valueOrder {
+		index.globalValues[i] = allPoints[id].cumValue
+	}
+	if err := progress.Step(len(allPoints)); err != nil {
+		return err
+	}
+
+	// Step 3: compute the global flat heat levels.
+	sort.Slice(valueOrder, func(i, j int) bool {
+		x := allPoints[valueOrder[i]]
+		y := allPoints[valueOrder[j]]
+		return flatPointGreater(x, y)
+	})
+	numFlat := 0
+	for _, id := range valueOrder {
+		if allPoints[id].flatValue == 0 {
+			break
+		}
+		numFlat++
+	}
+	assignLevels(numFlat, config.Threshold, func(i, level int) {
+		allPoints[valueOrder[i]].flags.SetGlobalFlatLevel(level)
+	})
+	// This is the last cancellation point: the remaining steps are fast.
+	if err := progress.Finish(); err != nil {
+		return err
+	}
+
+	// Step 4: demote the points that are not statistically meaningful.
+	if config.MinConfidence != 0 {
+		for i := range allPoints {
+			pt := &allPoints[i]
+			if sampleConfidence(expectedSamples(pt, index.valuePeriod)) < config.MinConfidence {
+				pt.flags.ClearLevels()
+			}
+		}
+	}
+
+	// Step 5: demote the points that are below the absolute cutoff.
+	minValue := index.minValue()
+	if minValue != 0 {
+		for i := range allPoints {
+			pt := &allPoints[i]
+			if pt.cumValue.Nanoseconds() < minValue {
+				pt.flags.SetLocalLevel(0)
+				pt.flags.SetGlobalLevel(0)
+			}
+			if pt.flatValue.Nanoseconds() < minValue {
+				pt.flags.SetLocalFlatLevel(0)
+				pt.flags.SetGlobalFlatLevel(0)
+			}
+		}
+	}
+
+	// Step 6: compute the per-function max levels.
+	for i := range index.funcs {
+		fn := &index.funcs[i]
+		fn.maxLocalLevel = 0
+		fn.maxGlobalLevel = 0
+		fn.maxLocalFlatLevel = 0
+		fn.maxGlobalFlatLevel = 0
+		funcData := allPoints[fn.dataFrom:fn.dataTo]
+		for i := range funcData {
+			pt := &funcData[i]
+			if pt.flags.GetLocalLevel() > int(fn.maxLocalLevel) {
+				fn.maxLocalLevel = uint8(pt.flags.GetLocalLevel())
+			}
+			if pt.flags.GetGlobalLevel() > int(fn.maxGlobalLevel) {
+				fn.maxGlobalLevel = uint8(pt.flags.GetGlobalLevel())
+			}
+			if pt.flags.GetLocalFlatLevel() > int(fn.maxLocalFlatLevel) {
+				fn.maxLocalFlatLevel = uint8(pt.flags.GetLocalFlatLevel())
+			}
+			if pt.flags.GetGlobalFlatLevel() > int(fn.maxGlobalFlatLevel) {
+				fn.maxGlobalFlatLevel = uint8(pt.flags.GetGlobalFlatLevel())
+			}
+		}
+	}
+
+	// Step 7: compute the function-level heat levels.
+	computeFuncLevels(index, minValue)
+
+	// Step 8: compute the group levels.
+	computeGroupLevels(index.pkgStats, config.Threshold, minValue)
+	computeGroupLevels(index.dirStats, config.Threshold, minValue)
+	computeGroupLevels(index.fileStats, config.Threshold, minValue)
+
+	// Step 9: drop the cold data points if requested.
+	if config.PruneCold {
+		pruneColdPoints(index)
+	}
+
+	return nil
+}
+
+// pruneColdPoints removes the data points that have no heat levels.
+// Functions that are left without data points are removed too,
+// along with the calls from the removed lines and functions.
+//
+// The heat levels are not changed, but the ranks are
+// computed among the remaining data points.
+func pruneColdPoints(index *Index) {
+	numPoints := 0
+	for i := range index.dataPoints {
+		if index.dataPoints[i].flags.HasLevels() {
+			numPoints++
+		}
+	}
+
+	points := make([]dataPoint, 0, numPoints)
+	funcs := make([]funcIndex, 0)
+	var keys []Key
+	newFuncIDs := make([]int32, len(index.funcs))
+	for funcID := range index.funcs {
+		newFuncIDs[funcID] = -1
+		fn := index.funcs[funcID]
+		from := len(points)
+		for _, pt := range index.dataPoints[fn.dataFrom:fn.dataTo] {
+			if pt.flags.HasLevels() {
+				points = append(points, pt)
+			}
+		}
+		if len(points) == from {
+			continue
+		}
+		fn.dataFrom = uint32(from)
+		fn.dataTo = uint32(len(points))
+		fn.minLine = points[fn.dataFrom].line
+		fn.maxLine = points[fn.dataTo-1].line
+		newFuncIDs[funcID] = int32(len(funcs))
+		funcs = append(funcs, fn)
+		keys = append(keys, index.funcTable.keys[funcID])
+	}
+
+	// The local ranks are computed among the remaining func points.
+	numLocalGreater := make([]uint32, len(points))
+	var values []durationValue
+	for i := range funcs {
+		fn := &funcs[i]
+		funcData := points[fn.dataFrom:fn.dataTo]
+		values = values[:0]
+		for _, pt := range funcData {
+			values = append(values, pt.cumValue)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			return values[i] > values[j]
+		})
+		setNumLocalGreater(numLocalGreater[fn.dataFrom:fn.dataTo], funcData, values)
+	}
+
+	var globalValues []durationValue
+	for i := range funcs {
+		fn := &funcs[i]
+		if !fn.inGlobalRanking {
+			continue
+		}
+		for _, pt := range points[fn.dataFrom:fn.dataTo] {
+			globalValues = append(globalValues, pt.cumValue)
+		}
+	}
+	sort.Slice(globalValues, func(i, j int) bool {
+		return globalValues[i] > globalValues[j]
+	})
+
+	index.dataPoints = points
+	index.numLocalGreater = numLocalGreater
+	index.funcs = funcs
+	index.funcTable = newFuncTable(keys)
+	index.globalValues = globalValues
+
+	// Drop the calls from the removed lines.
+	edges := remapCallEdges(nil, index.callEdges, newFuncIDs)
+	callEdges := edges[:0]
+	for _, e := range edges {
+		if index.findPoint(&index.funcs[e.callerID], e.line) != nil {
+			callEdges = append(callEdges, e)
+		}
+	}
+	index.callEdges = callEdges
+	index.callerOrder = buildCallerOrder(callEdges, len(funcs))
+
+	// Drop the stack traces bindings of the removed lines.
+	// The stack traces themselves are kept as they can
+	// pass through the other lines.
+	lineStacks := remapLineStacks(index.lineStacks, newFuncIDs)
+	n := 0
+	for _, r := range lineStacks {
+		if index.findPoint(&index.funcs[r.funcID], r.line) != nil {
+			lineStacks[n] = r
+			n++
+		}
+	}
+	index.lineStacks = lineStacks[:n]
+}
+
+func computeFuncLevels(index *Index, minValue int64) {
+	funcOrder := make([]uint32, 0, len(index.funcs))
+	for i := range index.funcs {
+		fn := &index.funcs[i]
+		fn.level = 0
+		fn.flatLevel = 0
+		if fn.inGlobalRanking {
+			funcOrder = append(funcOrder, uint32(i))
+		}
+	}
+
+	// The funcs slice order is deterministic, so a stable sort
+	// resolves the ties in a deterministic way too.
+	sort.SliceStable(funcOrder, func(i, j int) bool {
+		return index.funcs[funcOrder[i]].cumValue > index.funcs[funcOrder[j]].cumValue
+	})
+	assignLevels(len(funcOrder), index.config.Threshold, func(i, level int) {
+		fn := &index.funcs[funcOrder[i]]
+		if fn.cumValue >= minValue {
+			fn.level = uint8(level)
+		}
+	})
+
+	sort.SliceStable(funcOrder, func(i, j int) bool {
+		return index.funcs[funcOrder[i]].flatValue > index.funcs[funcOrder[j]].flatValue
+	})
+	numFlat := 0
+	for _, id := range funcOrder {
+		if index.funcs[id].flatValue == 0 {
+			break
+		}
+		numFlat++
+	}
+	assignLevels(numFlat, index.config.Threshold, func(i, level int) {
+		fn := &index.funcs[funcOrder[i]]
+		if fn.flatValue >= minValue {
+			fn.flatLevel = uint8(level)
+		}
+	})
+}
+
+// minValue returns the absolute hot value cutoff in nanoseconds.
+func (index *Index) minValue() int64 {
+	minValue := int64(index.config.MinValue)
+	if index.config.MinShare != 0 {
+		shareValue := int64(float64(index.totalValue) * index.config.MinShare)
+		if shareValue > minValue {
+			minValue = shareValue
+		}
+	}
+	return minValue
+}
+
+// funcThreshold returns the threshold for fn local heat levels.
+func (index *Index) funcThreshold(fn *funcIndex) float64 {
+	overrides := index.config.ThresholdOverrides
+	if len(overrides) == 0 {
+		return index.config.Threshold
+	}
+	threshold := index.config.Threshold
+	bestMatch := -1
+	pkgPath := index.pkgStats[fn.pkgID].name
+	filename := index.filenames[fn.fileID]
+	for _, o := range overrides {
+		if o.PkgPath != "" && len(o.PkgPath) > bestMatch && matchPkgPathPrefix(o.PkgPath, pkgPath) {
+			bestMatch = len(o.PkgPath)
+			threshold = o.Threshold
+		}
+		if o.FilePrefix != "" && len(o.FilePrefix) > bestMatch && strings.HasPrefix(filename, o.FilePrefix) {
+			bestMatch = len(o.FilePrefix)
+			threshold = o.Threshold
+		}
+	}
+	return threshold
+}
+
+// matchPkgPath reports whether pkgPath matches any of the import path prefixes.
+func matchPkgPath(prefixes []string, pkgPath string) bool {
+	for _, prefix := range prefixes {
+		if matchPkgPathPrefix(prefix, pkgPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPkgPathPrefix(prefix, pkgPath string) bool {
+	if !strings.HasPrefix(pkgPath, prefix) {
+		return false
+	}
+	return len(pkgPath) == len(prefix) || pkgPath[len(prefix)] == '/'
+}
+
+// setNumLocalGreater fills the numLocalGreater values for the func points.
+// values are the points values sorted in descending order.
+func setNumLocalGreater(dst []uint32, points []dataPoint, values []durationValue) {
+	for i := range points {
+		dst[i] = uint32(countGreater(values, points[i].cumValue))
+	}
+}
+
+// globalRank computes the LineStats.GlobalRank for pt.
+func (index *Index) globalRank(pt *dataPoint) float64 {
+	values := index.globalValues
+	numGreater := countGreater(values, pt.cumValue)
+	return float64(len(values)-numGreater) / float64(len(values))
+}
+
+func pointGreater(x, y dataPoint) bool {
+	if x.cumValue > y.cumValue {
+		return true
+	}
+	if x.cumValue < y.cumValue {
+		return false
+	}
+	return x.line > y.line
+}
+
+func flatPointGreater(x, y dataPoint) bool {
+	if x.flatValue > y.flatValue {
+		return true
+	}
+	if x.flatValue < y.flatValue {
+		return false
+	}
+	return x.line > y.line
+}
+
+// numFlatPoints reports the number of points with non-zero flat value.
+// The points are expected to be sorted by the flat value in descending order.
+func numFlatPoints(points []dataPoint) int {
+	for i := range points {
+		if points[i].flatValue == 0 {
+			return i
+		}
+	}
+	return len(points)
+}
+
+// assignLevels distributes the heat levels among the top n*threshold items.
+// The items are expected to be sorted in descending order, so
+// the item at index 0 always gets the max heat level.
+func assignLevels(n int, threshold float64, setLevel func(i, level int)) {
+	if n == 0 {
+		return
+	}
+	topn := int(float64(n) * threshold)
+	if topn == 0 {
+		topn = 1
+	}
+	currentLevel := maxHeatLevel
+	currentChunk := 0
+	forChunks(topn, maxHeatLevel, func(chunkNum, i int) {
+		if currentChunk != chunkNum {
+			currentLevel--
+			currentChunk = chunkNum
+		}
+		setLevel(i, currentLevel)
+	})
+}
@@ -3,18 +3,42 @@ package heatmap
 func memoryUsageApprox(index *Index) int {
 	size := 0
 
-	// Size for keys.
-	size += len(index.funcIDByKey) * (16 * 4)
-	// Size for values.
-	size += len(index.funcIDByKey) * 4
+	size += funcTableMemoryUsage(&index.funcTable)
 
 	size += cap(index.dataPoints) * 16
-	size += cap(index.funcs) * 24
+	size += cap(index.numLocalGreater) * 4
+	size += cap(index.globalValues) * 4
+	size += cap(index.funcs) * 48
+	size += cap(index.callEdges) * 20
+	size += cap(index.callerOrder) * 4
+	size += cap(index.stackNodes)*12 + cap(index.stacks)*12 + cap(index.lineStacks)*12
+	if len(index.stackKeys) != len(index.funcTable.keys) {
+		// Stack keys are shared with the func table unless
+		// this index was filtered.
+		size += cap(index.stackKeys) * (16 * 4)
+	}
 
 	size += cap(index.filenames) * 12
 	for _, filename := range index.filenames {
 		size += len(filename)
 	}
 
+	for _, comment := range index.metadata.Comments {
+		size += len(comment) + 16
+	}
+
+	// File stats share the names with filenames.
+	size += (cap(index.pkgStats) + cap(index.dirStats) + cap(index.fileStats)) * 40
+	for _, g := range index.pkgStats {
+		size += len(g.name)
+	}
+	for _, g := range index.dirStats {
+		size += len(g.name)
+	}
+
 	return size
 }
+
+func funcTableMemoryUsage(t *funcTable) int {
+	return cap(t.keys)*(16*4) + cap(t.slots)*4
+}
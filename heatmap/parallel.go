@@ -0,0 +1,45 @@
+package heatmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// parallelFor splits the [0, n) range into batches of the given size
+// and calls f for each of them using up to numWorkers goroutines.
+//
+// Batches are claimed in ascending order, so when f is called for
+// some batch, all preceding batches are either completed or in progress.
+//
+// The worker argument is in [0, numWorkers) range.
+// It can be used to access the worker-local state without locking.
+func parallelFor(n, batchSize, numWorkers int, f func(worker, from, to int)) {
+	numBatches := (n + batchSize - 1) / batchSize
+	if numWorkers > numBatches {
+		numWorkers = numBatches
+	}
+	if numWorkers <= 1 {
+		for from := 0; from < n; from += batchSize {
+			f(0, from, minInt(from+batchSize, n))
+		}
+		return
+	}
+
+	next := int64(-1)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for worker := 0; worker < numWorkers; worker++ {
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				batch := int(atomic.AddInt64(&next, 1))
+				if batch >= numBatches {
+					return
+				}
+				from := batch * batchSize
+				f(worker, from, minInt(from+batchSize, n))
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
@@ -2,6 +2,7 @@ package heatmap
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/google/pprof/profile"
@@ -70,6 +71,164 @@ func BenchmarkQuery(b *testing.B) {
 	benchQueryLine(b, benchIndexList[1], "matrix.go:data.newMatrix", 201, true)
 }
 
+func BenchmarkCompactQuery(b *testing.B) {
+	suite := benchIndexList[1]
+	compact := suite.i.Compact()
+	key := convertTestKey("matrix.go:data.newMatrix")
+	b.Run("QueryLine/Index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if suite.i.QueryLine(key, 201).HeatLevel == 0 {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+	b.Run("QueryLine/CompactIndex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if compact.QueryLine(key, 201).HeatLevel == 0 {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+}
+
+func BenchmarkFuncHandle(b *testing.B) {
+	suite := benchIndexList[1]
+	key := convertTestKey("matrix.go:data.newMatrix")
+	h, ok := suite.i.LookupFunc(key)
+	if !ok {
+		b.Fatal("func lookup failed")
+	}
+	b.Run("QueryLine/Key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if suite.i.QueryLine(key, 201).HeatLevel == 0 {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+	b.Run("QueryLine/Handle", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if h.QueryLine(201).HeatLevel == 0 {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+	lines := []int{195, 196, 197, 198, 199, 200, 201, 202}
+	out := make([]LineStats, len(lines))
+	b.Run("QueryLines/Loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j, line := range lines {
+				out[j] = suite.i.QueryLine(key, line)
+			}
+		}
+	})
+	b.Run("QueryLines/Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			suite.i.QueryLines(key, lines, out)
+		}
+	})
+	b.Run("Lookup/Map", func(b *testing.B) {
+		m := make(map[Key]uint32, suite.i.funcTable.Len())
+		for id, k := range suite.i.funcTable.keys {
+			m[k] = uint32(id)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := m[key]; !ok {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+	b.Run("Lookup/FuncTable", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok := suite.i.funcTable.Lookup(key); !ok {
+				b.Fatal("expected a hit, got a miss")
+			}
+		}
+	})
+}
+
+// BenchmarkAddProfile compares the sequential and parallel builds.
+// The parallel builds can only be faster if there are enough CPU cores;
+// on a single core they take about the same time as the sequential one.
+func BenchmarkAddProfile(b *testing.B) {
+	p := newRandomTestProfile(1, 100000)
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		config := IndexConfig{Parallelism: parallelism}
+		b.Run(fmt.Sprintf("parallelism%d", parallelism), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				index := NewIndex(config)
+				if err := index.AddProfile(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newRandomTestProfile creates a profile that looks like a real one:
+// a few thousands of functions spread over many packages and files,
+// deep stacks with inlined frames, some frames without a package.
+func newRandomTestProfile(seed int64, numSamples int) *profile.Profile {
+	r := rand.New(rand.NewSource(seed))
+
+	funcs := make([]*profile.Function, 3000)
+	for i := range funcs {
+		pkg := fmt.Sprintf("example.com/proj/pkg%d", i%150)
+		name := fmt.Sprintf("%s.f%d", pkg, i)
+		switch i % 7 {
+		case 0:
+			name = fmt.Sprintf("%s.(*T%d).m%d", pkg, i%5, i)
+		case 1:
+			name = fmt.Sprintf("%s.(T%d).m%d", pkg, i%5, i)
+		}
+		if i%500 == 0 {
+			name = fmt.Sprintf("asmfunc%d", i)
+		}
+		funcs[i] = &profile.Function{
+			ID:       uint64(i + 1),
+			Name:     name,
+			Filename: fmt.Sprintf("/home/user/%s/file%d.go", pkg, i%4),
+		}
+	}
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Function: funcs,
+	}
+	locations := make([]*profile.Location, 20000)
+	for i := range locations {
+		loc := &profile.Location{ID: uint64(i + 1)}
+		// Some locations have inlined calls.
+		numLines := 1 + r.Intn(3)/2
+		for j := 0; j < numLines; j++ {
+			loc.Line = append(loc.Line, profile.Line{
+				Function: funcs[r.Intn(len(funcs))],
+				Line:     int64(1 + r.Intn(300)),
+			})
+		}
+		locations[i] = loc
+	}
+	p.Location = locations
+
+	p.Sample = make([]*profile.Sample, numSamples)
+	for i := range p.Sample {
+		depth := 1 + r.Intn(30)
+		s := &profile.Sample{
+			Value:    []int64{1, int64(1+r.Intn(20)) * 10000000},
+			Location: make([]*profile.Location, depth),
+		}
+		for j := range s.Location {
+			s.Location[j] = locations[r.Intn(len(locations))]
+		}
+		p.Sample[i] = s
+	}
+	return p
+}
+
 type benchIndex struct {
 	name string
 	i    *Index
@@ -0,0 +1,130 @@
+package heatmap
+
+import (
+	"sort"
+)
+
+// pointRecord is a data point that is bound to a function.
+type pointRecord struct {
+	funcID uint32
+	pt     dataPoint
+}
+
+// pointBuffer aggregates the data points without using maps.
+//
+// Records are appended as is; when the buffer is full, the records
+// are sorted by (funcID, line) and the duplicates are merged together.
+// The buffer only grows if the compaction freed less than a half of it,
+// so its size stays proportional to the number of unique points.
+type pointBuffer struct {
+	records []pointRecord
+
+	// numSorted is a length of the sorted and compacted records prefix.
+	numSorted int
+
+	// scratch holds the new records while they're merged into the prefix.
+	scratch []pointRecord
+}
+
+// minPointBufferSize is an initial pointBuffer capacity.
+const minPointBufferSize = 4096
+
+func (b *pointBuffer) Add(funcID uint32, pt dataPoint) {
+	if len(b.records) == cap(b.records) {
+		b.Compact()
+		if len(b.records) > cap(b.records)/2 {
+			records := make([]pointRecord, len(b.records), 2*cap(b.records)+minPointBufferSize)
+			copy(records, b.records)
+			b.records = records
+		}
+	}
+	b.records = append(b.records, pointRecord{funcID: funcID, pt: pt})
+}
+
+// Compact sorts the records and merges the duplicates.
+// Only the records that were added after the previous compaction
+// are sorted, then they're merged into the already compacted prefix.
+func (b *pointBuffer) Compact() {
+	if b.numSorted == len(b.records) {
+		return
+	}
+	tail := compactPointRecords(b.records[b.numSorted:])
+	b.scratch = append(b.scratch[:0], tail...)
+	b.records = mergeSortedPointRecords(b.records, b.numSorted, b.scratch)
+	b.numSorted = len(b.records)
+}
+
+func compactPointRecords(records []pointRecord) []pointRecord {
+	if len(records) == 0 {
+		return records
+	}
+	sort.Sort(pointRecordsByLine(records))
+	dst := 0
+	for _, r := range records[1:] {
+		prev := &records[dst]
+		if r.funcID == prev.funcID && r.pt.line == prev.pt.line {
+			prev.pt.addPoint(&r.pt)
+			continue
+		}
+		dst++
+		records[dst] = r
+	}
+	return records[:dst+1]
+}
+
+// mergeSortedPointRecords merges the compacted tail into the compacted
+// records[:n] prefix; the result is written to the records.
+// The tail should not share the memory with the records,
+// but the records should have a room for the tail after the prefix.
+//
+// The records are merged from the end, so no other buffers are needed.
+func mergeSortedPointRecords(records []pointRecord, n int, tail []pointRecord) []pointRecord {
+	i := n - 1
+	k := n + len(tail)
+	for j := len(tail) - 1; j >= 0; {
+		k--
+		if i >= 0 {
+			x := &records[i]
+			y := &tail[j]
+			if x.funcID == y.funcID && x.pt.line == y.pt.line {
+				merged := *x
+				merged.pt.addPoint(&y.pt)
+				records[k] = merged
+				i--
+				j--
+				continue
+			}
+			if pointRecordLess(y, x) {
+				records[k] = *x
+				i--
+				continue
+			}
+		}
+		records[k] = tail[j]
+		j--
+	}
+	// The merged duplicates leave a gap after the untouched prefix part.
+	copy(records[i+1:], records[k:n+len(tail)])
+	return records[:i+1+n+len(tail)-k]
+}
+
+type pointRecordsByLine []pointRecord
+
+func (records pointRecordsByLine) Len() int {
+	return len(records)
+}
+
+func (records pointRecordsByLine) Swap(i, j int) {
+	records[i], records[j] = records[j], records[i]
+}
+
+func (records pointRecordsByLine) Less(i, j int) bool {
+	return pointRecordLess(&records[i], &records[j])
+}
+
+func pointRecordLess(x, y *pointRecord) bool {
+	if x.funcID != y.funcID {
+		return x.funcID < y.funcID
+	}
+	return x.pt.line < y.pt.line
+}
@@ -0,0 +1,53 @@
+package heatmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPointBuffer(t *testing.T) {
+	type pointKey struct {
+		funcID uint32
+		line   uint32
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, numUnique := range []int{1, 10, 5000, 20000} {
+		var b pointBuffer
+		want := map[pointKey]dataPoint{}
+		for i := 0; i < 50000; i++ {
+			id := r.Intn(numUnique)
+			key := pointKey{funcID: uint32(id % 97), line: uint32(id)}
+			pt := dataPoint{
+				line:       key.line,
+				numSamples: 1,
+				cumValue:   durationValue(r.Intn(100)),
+				flatValue:  durationValue(r.Intn(100)),
+			}
+			b.Add(key.funcID, pt)
+			wantPt := want[key]
+			wantPt.line = key.line
+			wantPt.numSamples++
+			wantPt.cumValue += pt.cumValue
+			wantPt.flatValue += pt.flatValue
+			want[key] = wantPt
+		}
+		b.Compact()
+
+		if len(b.records) != len(want) {
+			t.Fatalf("unique=%d: have %d records, want %d", numUnique, len(b.records), len(want))
+		}
+		for i, rec := range b.records {
+			if i != 0 && !pointRecordsByLine(b.records).Less(i-1, i) {
+				t.Fatalf("unique=%d: records are not sorted at %d", numUnique, i)
+			}
+			key := pointKey{funcID: rec.funcID, line: rec.pt.line}
+			if want[key] != rec.pt {
+				t.Fatalf("unique=%d: %v: have %+v, want %+v", numUnique, key, rec.pt, want[key])
+			}
+		}
+		if cap(b.records) > 4*len(want)+minPointBufferSize {
+			t.Errorf("unique=%d: buffer capacity %d is too big", numUnique, cap(b.records))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package heatmap
+
+import (
+	"context"
+	"sync"
+)
+
+// ProgressPhase identifies the index building stage.
+type ProgressPhase int
+
+const (
+	// PhaseAggregate is a profile samples aggregation phase.
+	// It's usually the longest one.
+	PhaseAggregate ProgressPhase = iota
+
+	// PhaseSort is a phase where the aggregated data is sorted
+	// and packed into the index.
+	PhaseSort
+
+	// PhaseLevels is a heat levels computation phase.
+	// Most of its time is spent on sorting the data points by their values.
+	PhaseLevels
+)
+
+func (phase ProgressPhase) String() string {
+	switch phase {
+	case PhaseAggregate:
+		return "aggregate"
+	case PhaseSort:
+		return "sort"
+	case PhaseLevels:
+		return "levels"
+	default:
+		return "unknown"
+	}
+}
+
+// Progress describes the index building state.
+type Progress struct {
+	Phase ProgressPhase
+
+	// Percent is a phase completion percentage, in [0, 100] range.
+	Percent float64
+}
+
+// ProgressFunc is called during the index building to report its progress.
+// It's called synchronously, so it should return quickly.
+type ProgressFunc func(Progress)
+
+// progressStep is a number of items processed between
+// the cancellation checks and the progress reports.
+const progressStep = 1024
+
+// progressTracker reports the phase progress and checks
+// whether the index building was cancelled.
+//
+// Step can be called from several goroutines.
+type progressTracker struct {
+	ctx      context.Context
+	callback ProgressFunc
+
+	mu    sync.Mutex
+	phase ProgressPhase
+	total int
+	done  int
+}
+
+// Start reports the phase beginning.
+// total is a number of items the phase is going to process.
+func (t *progressTracker) Start(phase ProgressPhase, total int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phase = phase
+	t.total = total
+	t.done = 0
+	return t.report(0)
+}
+
+// Step marks n more items of the current phase as processed.
+func (t *progressTracker) Step(n int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += n
+	percent := float64(100)
+	if t.done < t.total {
+		percent = 100 * float64(t.done) / float64(t.total)
+	}
+	return t.report(percent)
+}
+
+// Finish reports the current phase completion.
+func (t *progressTracker) Finish() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report(100)
+}
+
+func (t *progressTracker) report(percent float64) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	if t.callback != nil {
+		t.callback(Progress{Phase: t.phase, Percent: percent})
+	}
+	return nil
+}
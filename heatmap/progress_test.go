@@ -0,0 +1,89 @@
+package heatmap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func newLargeTestProfile() *profile.Profile {
+	b := newTestProfileBuilder()
+	for i := 0; i < 3000; i++ {
+		b.AddSamples("a.go:pkg.f", 10000, []int{i%100 + 1})
+	}
+	return b.Build()
+}
+
+func TestAddProfileProgress(t *testing.T) {
+	var events []Progress
+	index := NewIndex(IndexConfig{})
+	err := index.AddProfileContext(context.Background(), newLargeTestProfile(), func(p Progress) {
+		events = append(events, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) == 0 {
+		t.Fatal("no progress events reported")
+	}
+	numAggregate := 0
+	numLevels := 0
+	for i, e := range events {
+		if e.Percent < 0 || e.Percent > 100 {
+			t.Errorf("event %d: percent %v is out of range", i, e.Percent)
+		}
+		switch e.Phase {
+		case PhaseAggregate:
+			numAggregate++
+		case PhaseLevels:
+			numLevels++
+		}
+		if i == 0 {
+			continue
+		}
+		prev := events[i-1]
+		if e.Phase < prev.Phase || (e.Phase == prev.Phase && e.Percent < prev.Percent) {
+			t.Errorf("event %d: %s %.2f%% goes after %s %.2f%%", i, e.Phase, e.Percent, prev.Phase, prev.Percent)
+		}
+	}
+	if numAggregate < 3 {
+		t.Errorf("have %d aggregate events, want at least 3", numAggregate)
+	}
+	if numLevels < 3 {
+		t.Errorf("have %d levels events, want at least 3", numLevels)
+	}
+	last := events[len(events)-1]
+	if last != (Progress{Phase: PhaseLevels, Percent: 100}) {
+		t.Errorf("unexpected last event: %+v", last)
+	}
+}
+
+func TestAddProfileCancel(t *testing.T) {
+	for _, phase := range []ProgressPhase{PhaseAggregate, PhaseSort, PhaseLevels} {
+		ctx, cancel := context.WithCancel(context.Background())
+		index := NewIndex(IndexConfig{})
+		err := index.AddProfileContext(ctx, newLargeTestProfile(), func(p Progress) {
+			if p.Phase == phase && p.Percent > 0 {
+				cancel()
+			}
+		})
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: have %v error, want context.Canceled", phase, err)
+		}
+
+		// The cancelled index should be left unmodified and usable.
+		if index.MemoryUsageApprox() != NewIndex(IndexConfig{}).MemoryUsageApprox() {
+			t.Fatalf("%s: cancelled index is not empty", phase)
+		}
+		if err := index.AddProfile(newLargeTestProfile()); err != nil {
+			t.Fatal(err)
+		}
+		if info := index.QueryFunc(convertTestKey("a.go:pkg.f")); info.Value != 3000*10000 {
+			t.Fatalf("%s: have %d func value, want %d", phase, info.Value, 3000*10000)
+		}
+	}
+}
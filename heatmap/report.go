@@ -0,0 +1,205 @@
+package heatmap
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// Report contains the diagnostics that are collected while adding a profile.
+// It helps to understand why some samples didn't make it into the index.
+type Report struct {
+	// NumSamples is the number of processed profile samples.
+	NumSamples int
+
+	// NumFrames is the number of processed stack frames among all samples.
+	// Inlined calls are counted as separate frames.
+	NumFrames int
+
+	// NumFuncs and NumLines describe the resulting index size.
+	NumFuncs int
+	NumLines int
+
+	// UnsymbolizedLocations is the number of unique profile locations
+	// that have no line info.
+	UnsymbolizedLocations int
+
+	// DroppedSamples are samples that didn't contribute to any index data point.
+	// A dropped sample reason is the reason of its leaf-most dropped frame;
+	// samples without any line info are counted as unsymbolized.
+	// The samples with a too small value are skipped without
+	// walking their frames, so these frames are not counted.
+	DroppedSamples DropCounts
+
+	// DroppedFrames are frames that were skipped during the indexing.
+	DroppedFrames DropCounts
+
+	// TopDroppedSymbols lists the symbols with the highest
+	// dropped frames value, in descending order.
+	TopDroppedSymbols []DroppedSymbol
+}
+
+// DropCounts holds the counters for every DropReason.
+type DropCounts struct {
+	NoPackage    int
+	LineOverflow int
+	Unsymbolized int
+	SmallValue   int
+}
+
+// Total returns the sum of all counters.
+func (c DropCounts) Total() int {
+	return c.NoPackage + c.LineOverflow + c.Unsymbolized + c.SmallValue
+}
+
+// Add increments the counter that corresponds to the reason.
+func (c *DropCounts) Add(reason DropReason) {
+	switch reason {
+	case DropNoPackage:
+		c.NoPackage++
+	case DropLineOverflow:
+		c.LineOverflow++
+	case DropUnsymbolized:
+		c.Unsymbolized++
+	case DropSmallValue:
+		c.SmallValue++
+	}
+}
+
+func (c *DropCounts) merge(other DropCounts) {
+	c.NoPackage += other.NoPackage
+	c.LineOverflow += other.LineOverflow
+	c.Unsymbolized += other.Unsymbolized
+	c.SmallValue += other.SmallValue
+}
+
+// DroppedSymbol describes a symbol that had its frames dropped.
+type DroppedSymbol struct {
+	// Name is a symbol name as it's recorded in the profile.
+	// For unsymbolized frames, it's a mapping file name.
+	Name string
+
+	Reason DropReason
+
+	// NumFrames is the number of dropped frames for this symbol.
+	NumFrames int
+
+	// Value is the total samples value of the dropped frames.
+	Value int64
+}
+
+// DropReason describes why some frame or sample was not indexed.
+type DropReason int
+
+const (
+	// DropNoPackage is used for symbols without a package name.
+	// This includes the assembly routines that are not attached to any package.
+	DropNoPackage DropReason = iota
+
+	// DropLineOverflow is used for line numbers that don't fit into uint32.
+	DropLineOverflow
+
+	// DropUnsymbolized is used for locations without line info.
+	DropUnsymbolized
+
+	// DropSmallValue is used for samples with a value that is less than 1µs.
+	// The index stores the values in microseconds, so such samples
+	// can't be represented in it.
+	DropSmallValue
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropNoPackage:
+		return "no package"
+	case DropLineOverflow:
+		return "line overflow"
+	case DropUnsymbolized:
+		return "unsymbolized"
+	case DropSmallValue:
+		return "small value"
+	default:
+		return fmt.Sprintf("DropReason(%d)", int(r))
+	}
+}
+
+// maxTopDroppedSymbols limits the Report.TopDroppedSymbols length.
+const maxTopDroppedSymbols = 10
+
+type reportCollector struct {
+	report Report
+
+	droppedSymbols map[DroppedSymbol]*DroppedSymbol
+}
+
+func newReportCollector() *reportCollector {
+	return &reportCollector{
+		droppedSymbols: map[DroppedSymbol]*DroppedSymbol{},
+	}
+}
+
+func (c *reportCollector) CountLocations(p *profile.Profile) {
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			c.report.UnsymbolizedLocations++
+		}
+	}
+}
+
+func (c *reportCollector) AddDroppedFrame(reason DropReason, name string, value int64) {
+	c.report.DroppedFrames.Add(reason)
+	key := DroppedSymbol{Name: name, Reason: reason}
+	sym := c.droppedSymbols[key]
+	if sym == nil {
+		sym = &DroppedSymbol{Name: name, Reason: reason}
+		c.droppedSymbols[key] = sym
+	}
+	sym.NumFrames++
+	sym.Value += value
+}
+
+// Merge adds the samples and frames stats collected by other.
+func (c *reportCollector) Merge(other *reportCollector) {
+	c.report.NumSamples += other.report.NumSamples
+	c.report.NumFrames += other.report.NumFrames
+	c.report.DroppedSamples.merge(other.report.DroppedSamples)
+	c.report.DroppedFrames.merge(other.report.DroppedFrames)
+	for key, otherSym := range other.droppedSymbols {
+		sym := c.droppedSymbols[key]
+		if sym == nil {
+			sym = &DroppedSymbol{Name: key.Name, Reason: key.Reason}
+			c.droppedSymbols[key] = sym
+		}
+		sym.NumFrames += otherSym.NumFrames
+		sym.Value += otherSym.Value
+	}
+}
+
+func (c *reportCollector) Finish() *Report {
+	symbols := make([]DroppedSymbol, 0, len(c.droppedSymbols))
+	for _, sym := range c.droppedSymbols {
+		symbols = append(symbols, *sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Value != symbols[j].Value {
+			return symbols[i].Value > symbols[j].Value
+		}
+		if symbols[i].Name != symbols[j].Name {
+			return symbols[i].Name < symbols[j].Name
+		}
+		return symbols[i].Reason < symbols[j].Reason
+	})
+	if len(symbols) > maxTopDroppedSymbols {
+		symbols = symbols[:maxTopDroppedSymbols]
+	}
+	c.report.TopDroppedSymbols = symbols
+	return &c.report
+}
+
+func unsymbolizedName(loc *profile.Location) string {
+	if loc.Mapping != nil && loc.Mapping.File != "" {
+		return loc.Mapping.File
+	}
+	return "<unknown>"
+}
@@ -0,0 +1,79 @@
+package heatmap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/pprof/profile"
+)
+
+func TestReport(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddStack(30000, "asm.s:indexbytebody:10", "a.go:pkg.f:5").
+		AddStack(20000, "asm.s:indexbytebody:10").
+		AddStack(10000, "asm.s:memmove:3").
+		AddStack(40000, "a.go:pkg.f:6").
+		AddStack(999, "a.go:pkg.f:6").
+		Build()
+	unsymbolized := &profile.Location{
+		Mapping: &profile.Mapping{File: "/lib/libc.so"},
+	}
+	p.Location = append(p.Location, unsymbolized)
+	p.Sample = append(p.Sample, &profile.Sample{
+		Value:    []int64{1, 50000},
+		Location: []*profile.Location{unsymbolized},
+	})
+
+	index := NewIndex(IndexConfig{Threshold: 0.5})
+	report, err := index.AddProfileWithReport(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Report{
+		NumSamples:            6,
+		NumFrames:             6,
+		NumFuncs:              1,
+		NumLines:              2,
+		UnsymbolizedLocations: 1,
+		DroppedSamples: DropCounts{
+			NoPackage:    2,
+			Unsymbolized: 1,
+			SmallValue:   1,
+		},
+		DroppedFrames: DropCounts{
+			NoPackage:    3,
+			Unsymbolized: 1,
+		},
+		TopDroppedSymbols: []DroppedSymbol{
+			{Name: "/lib/libc.so", Reason: DropUnsymbolized, NumFrames: 1, Value: 50000},
+			{Name: "indexbytebody", Reason: DropNoPackage, NumFrames: 2, Value: 50000},
+			{Name: "memmove", Reason: DropNoPackage, NumFrames: 1, Value: 10000},
+		},
+	}
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Errorf("report mismatch (-want +have):\n%s", diff)
+	}
+	if report.DroppedSamples.Total() != 4 {
+		t.Errorf("dropped samples total: have %d, want 4", report.DroppedSamples.Total())
+	}
+}
+
+func TestReportOnError(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddStack(10000, "asm.s:memmove:3").
+		Build()
+
+	index := NewIndex(IndexConfig{})
+	report, err := index.AddProfileWithReport(p)
+	if !errors.Is(err, ErrNoSamples) {
+		t.Fatalf("have %v error, want ErrNoSamples", err)
+	}
+	if report == nil {
+		t.Fatal("expected a non-nil report")
+	}
+	if report.DroppedSamples.NoPackage != 1 {
+		t.Errorf("have %d no-package dropped samples, want 1", report.DroppedSamples.NoPackage)
+	}
+}
@@ -0,0 +1,303 @@
+package heatmap
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StackTrace is a unique profile stack trace.
+type StackTrace struct {
+	// Frames are ordered from the innermost call to the outermost caller,
+	// like in the profile samples.
+	// Frames that can't be indexed are not included.
+	Frames []StackFrame
+
+	// Value is the aggregated value of all samples with this stack trace.
+	Value int64
+
+	// NumSamples is the number of samples with this stack trace.
+	NumSamples int
+
+	// LineShare is the Value relative to the queried line value.
+	LineShare float64
+}
+
+// StackFrame is a single StackTrace function call.
+type StackFrame struct {
+	Func Key
+	Line int
+}
+
+// QueryStacks returns up to k hottest stack traces that pass through the given line.
+// The results are sorted by Value in descending order.
+//
+// The stack traces are only recorded if IndexConfig.StacksPerLine is not 0;
+// at most StacksPerLine stack traces are available for every line.
+// If there are no stack traces for this line, nil is returned.
+func (index *Index) QueryStacks(key Key, line int, k int) []StackTrace {
+	funcID, ok := index.funcTable.Lookup(key)
+	if !ok || line < 0 || k <= 0 {
+		return nil
+	}
+	pt := index.findPoint(&index.funcs[funcID], uint32(line))
+	if pt == nil {
+		return nil
+	}
+
+	refs := index.lineStacks
+	from := sort.Search(len(refs), func(i int) bool {
+		r := &refs[i]
+		return r.funcID > funcID || (r.funcID == funcID && r.line >= uint32(line))
+	})
+	var result []StackTrace
+	for i := from; i < len(refs) && len(result) < k; i++ {
+		r := &refs[i]
+		if r.funcID != funcID || r.line != uint32(line) {
+			break
+		}
+		result = append(result, index.stackTrace(&index.stacks[r.stackID], pt))
+	}
+	return result
+}
+
+// LookupLine returns the keys of the functions that have the given file line data point.
+// The filename can be either a base file name or a full path suffix,
+// so both "buffer.go" and "bytes/buffer.go" would match "/go/src/bytes/buffer.go".
+func (index *Index) LookupLine(filename string, line int) []Key {
+	if line < 0 {
+		return nil
+	}
+	base := filepath.Base(filename)
+	var keys []Key
+	for funcID, key := range index.funcTable.keys {
+		if key.Filename != base {
+			continue
+		}
+		fn := &index.funcs[funcID]
+		fullName := index.filenames[fn.fileID]
+		if fullName != filename && !strings.HasSuffix(fullName, "/"+filename) {
+			continue
+		}
+		if index.findPoint(fn, uint32(line)) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (index *Index) stackTrace(s *stackRecord, pt *dataPoint) StackTrace {
+	trace := StackTrace{
+		Value:      s.value.Nanoseconds(),
+		NumSamples: int(s.numSamples),
+	}
+	if pt.cumValue != 0 {
+		trace.LineShare = float64(s.value) / float64(pt.cumValue)
+	}
+	for nodeID := s.leaf; nodeID != noStackNode; nodeID = index.stackNodes[nodeID].parent {
+		node := &index.stackNodes[nodeID]
+		trace.Frames = append(trace.Frames, StackFrame{
+			Func: index.stackKeys[node.funcID],
+			Line: int(node.line),
+		})
+	}
+	return trace
+}
+
+// noStackNode is a stackNode.parent value for the outermost frames.
+const noStackNode = ^uint32(0)
+
+// stackNode is a stack traces prefix tree node.
+// The tree roots are the outermost callers; every unique
+// stack trace is identified by its innermost call node.
+//
+// A node parent always has a lower ID than the node itself.
+type stackNode struct {
+	parent uint32
+	funcID uint32
+	line   uint32
+}
+
+// stackRecord is an aggregated unique stack trace.
+type stackRecord struct {
+	leaf       uint32
+	value      durationValue
+	numSamples sampleCount
+}
+
+// lineStack binds a stack trace to a line it passes through.
+type lineStack struct {
+	funcID  uint32
+	line    uint32
+	stackID uint32
+}
+
+// stackTreeBuilder collects the sample stack traces into a prefix tree.
+//
+// It's used after the samples are aggregated, so only the
+// frames that have a data point are passed to it.
+type stackTreeBuilder struct {
+	nodes    []stackNode
+	children map[stackNode]uint32
+
+	// stacks are indexed by the node IDs;
+	// a zero value means that there are no stack traces that end at this node.
+	stacks []stackRecord
+}
+
+func newStackTreeBuilder() *stackTreeBuilder {
+	return &stackTreeBuilder{
+		children: map[stackNode]uint32{},
+	}
+}
+
+// AddStack adds a stack trace with the given value.
+// The frames are ordered from the outermost caller to the innermost call.
+func (b *stackTreeBuilder) AddStack(frames []stackNode, value durationValue, numSamples int64) {
+	if len(frames) == 0 {
+		return
+	}
+	nodeID := noStackNode
+	for _, frame := range frames {
+		frame.parent = nodeID
+		id, ok := b.children[frame]
+		if !ok {
+			id = uint32(len(b.nodes))
+			b.nodes = append(b.nodes, frame)
+			b.stacks = append(b.stacks, stackRecord{leaf: id})
+			b.children[frame] = id
+		}
+		nodeID = id
+	}
+	s := &b.stacks[nodeID]
+	s.value += value
+	s.numSamples = s.numSamples.Add(numSamples)
+}
+
+// Build sets the index stack traces data.
+// Only stacksPerLine hottest stack traces are kept for every line.
+//
+// newFuncIDs maps the func IDs used by the added stack
+// traces to the index func IDs.
+func (b *stackTreeBuilder) Build(index *Index, newFuncIDs []int32, stacksPerLine int) {
+	// Collect the unique stack traces, hottest first.
+	stacks := make([]stackRecord, 0, len(b.stacks))
+	for _, s := range b.stacks {
+		if s.value != 0 {
+			stacks = append(stacks, s)
+		}
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].value != stacks[j].value {
+			return stacks[i].value > stacks[j].value
+		}
+		return stacks[i].leaf < stacks[j].leaf
+	})
+
+	// Bind the stack traces to the lines they pass through.
+	// The stacks are sorted by value, so every line gets its
+	// hottest stack traces first.
+	type lineKey struct {
+		funcID uint32
+		line   uint32
+	}
+	numLineStacks := map[lineKey]int{}
+	var refs []lineStack
+	var frames []lineKey
+	numUsed := 0
+	for _, s := range stacks {
+		frames = frames[:0]
+		for nodeID := s.leaf; nodeID != noStackNode; nodeID = b.nodes[nodeID].parent {
+			node := &b.nodes[nodeID]
+			k := lineKey{funcID: uint32(newFuncIDs[node.funcID]), line: node.line}
+			// Recursive calls should not bind the same stack trace twice.
+			duplicate := false
+			for _, prev := range frames {
+				if prev == k {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				frames = append(frames, k)
+			}
+		}
+		used := false
+		for _, k := range frames {
+			if numLineStacks[k] == stacksPerLine {
+				continue
+			}
+			numLineStacks[k]++
+			used = true
+			refs = append(refs, lineStack{funcID: k.funcID, line: k.line, stackID: uint32(numUsed)})
+		}
+		if used {
+			stacks[numUsed] = s
+			numUsed++
+		}
+	}
+	stacks = stacks[:numUsed]
+	sort.Slice(refs, func(i, j int) bool {
+		x := &refs[i]
+		y := &refs[j]
+		if x.funcID != y.funcID {
+			return x.funcID < y.funcID
+		}
+		if x.line != y.line {
+			return x.line < y.line
+		}
+		return x.stackID < y.stackID
+	})
+
+	// Keep only the nodes of the used stack traces.
+	// Parents have lower IDs, so the new IDs keep this property.
+	newNodeIDs := make([]uint32, len(b.nodes))
+	for i := range newNodeIDs {
+		newNodeIDs[i] = noStackNode
+	}
+	for _, s := range stacks {
+		for nodeID := s.leaf; nodeID != noStackNode && newNodeIDs[nodeID] == noStackNode; nodeID = b.nodes[nodeID].parent {
+			newNodeIDs[nodeID] = 0
+		}
+	}
+	numNodes := 0
+	for i, id := range newNodeIDs {
+		if id != noStackNode {
+			newNodeIDs[i] = uint32(numNodes)
+			numNodes++
+		}
+	}
+	nodes := make([]stackNode, 0, numNodes)
+	for i, node := range b.nodes {
+		if newNodeIDs[i] == noStackNode {
+			continue
+		}
+		if node.parent != noStackNode {
+			node.parent = newNodeIDs[node.parent]
+		}
+		node.funcID = uint32(newFuncIDs[node.funcID])
+		nodes = append(nodes, node)
+	}
+	for i := range stacks {
+		stacks[i].leaf = newNodeIDs[stacks[i].leaf]
+	}
+
+	index.stackKeys = index.funcTable.keys
+	index.stackNodes = nodes
+	index.stacks = stacks
+	index.lineStacks = refs
+}
+
+// remapLineStacks is like remapCallEdges, but for the lineStacks.
+func remapLineStacks(refs []lineStack, newFuncIDs []int32) []lineStack {
+	var result []lineStack
+	for _, r := range refs {
+		funcID := newFuncIDs[r.funcID]
+		if funcID == -1 {
+			continue
+		}
+		r.funcID = uint32(funcID)
+		result = append(result, r)
+	}
+	return result
+}
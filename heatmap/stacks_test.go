@@ -0,0 +1,158 @@
+package heatmap
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStacks(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddStack(70000, "json.go:json.Unmarshal:10", "a.go:main.f:5", "main.go:main.main:20").
+		AddStack(10000, "json.go:json.Unmarshal:10", "a.go:main.f:5", "main.go:main.main:20").
+		AddStack(30000, "b.go:main.g:3", "a.go:main.f:5", "main.go:main.main:20").
+		AddStack(20000, "a.go:main.f:5", "main.go:main.main:21").
+		AddStack(40000, "json.go:json.Unmarshal:12", "c.go:main.h:7", "main.go:main.main:22").
+		AddStack(50000, "d.go:main.rec:1", "d.go:main.rec:2", "d.go:main.rec:2", "main.go:main.main:23").
+		Build()
+
+	index := NewIndex(IndexConfig{StacksPerLine: 2})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	stack := func(value int64, numSamples int, share float64, frames ...string) StackTrace {
+		trace := StackTrace{Value: value, NumSamples: numSamples, LineShare: share}
+		for _, frame := range frames {
+			key, line := convertTestFrame(frame)
+			trace.Frames = append(trace.Frames, StackFrame{Func: key, Line: line})
+		}
+		return trace
+	}
+
+	tests := []struct {
+		frame string
+		k     int
+		want  []StackTrace
+	}{
+		{
+			frame: "a.go:main.f:5",
+			k:     10,
+			want: []StackTrace{
+				stack(80000, 2, 80.0/130.0, "json.go:json.Unmarshal:10", "a.go:main.f:5", "main.go:main.main:20"),
+				stack(30000, 1, 30.0/130.0, "b.go:main.g:3", "a.go:main.f:5", "main.go:main.main:20"),
+			},
+		},
+		{
+			frame: "a.go:main.f:5",
+			k:     1,
+			want: []StackTrace{
+				stack(80000, 2, 80.0/130.0, "json.go:json.Unmarshal:10", "a.go:main.f:5", "main.go:main.main:20"),
+			},
+		},
+		{
+			frame: "main.go:main.main:21",
+			k:     10,
+			want: []StackTrace{
+				stack(20000, 1, 1, "a.go:main.f:5", "main.go:main.main:21"),
+			},
+		},
+		{
+			// Recursive calls count the sample only once for the line value.
+			frame: "d.go:main.rec:2",
+			k:     10,
+			want: []StackTrace{
+				stack(50000, 1, 1, "d.go:main.rec:1", "d.go:main.rec:2", "d.go:main.rec:2", "main.go:main.main:23"),
+			},
+		},
+		{
+			frame: "a.go:main.f:6",
+			k:     10,
+		},
+		{
+			frame: "a.go:main.f:5",
+			k:     0,
+		},
+	}
+
+	for _, test := range tests {
+		key, line := convertTestFrame(test.frame)
+		have := index.QueryStacks(key, line, test.k)
+		if diff := cmp.Diff(test.want, have); diff != "" {
+			t.Errorf("QueryStacks(%s, %d) mismatch (-want +have):\n%s", test.frame, test.k, diff)
+		}
+	}
+
+	// Filtered index keeps the full stack traces.
+	filtered := index.Filter(func(info FuncInfo) bool {
+		return info.Filename == "a.go"
+	})
+	key, line := convertTestFrame("a.go:main.f:5")
+	if diff := cmp.Diff(index.QueryStacks(key, line, 10), filtered.QueryStacks(key, line, 10)); diff != "" {
+		t.Errorf("filtered QueryStacks mismatch (-want +have):\n%s", diff)
+	}
+	key, line = convertTestFrame("main.go:main.main:20")
+	if have := filtered.QueryStacks(key, line, 10); have != nil {
+		t.Errorf("filtered QueryStacks for a removed func: expected nil, got %v", have)
+	}
+
+	// No stack traces are recorded by default.
+	index = NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	key, line = convertTestFrame("a.go:main.f:5")
+	if have := index.QueryStacks(key, line, 10); have != nil {
+		t.Errorf("QueryStacks without StacksPerLine: expected nil, got %v", have)
+	}
+}
+
+func TestLookupLine(t *testing.T) {
+	p := newTestProfileBuilder().
+		AddSamples("/src/pkg/a.go:pkg.f", 10000, []int{5, 6}).
+		AddSamples("/src/pkg/a.go:pkg.g", 10000, []int{10}).
+		AddSamples("/src/other/a.go:other.f", 10000, []int{5}).
+		Build()
+	index := NewIndex(IndexConfig{})
+	if err := index.AddProfile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		line     int
+		want     []string
+	}{
+		{"a.go", 5, []string{"/src/other/a.go:other.f", "/src/pkg/a.go:pkg.f"}},
+		{"pkg/a.go", 5, []string{"/src/pkg/a.go:pkg.f"}},
+		{"/src/pkg/a.go", 10, []string{"/src/pkg/a.go:pkg.g"}},
+		{"kg/a.go", 5, nil},
+		{"a.go", 7, nil},
+		{"b.go", 5, nil},
+	}
+	for _, test := range tests {
+		var want []Key
+		for _, s := range test.want {
+			key := convertTestKey(s)
+			key.Filename = filepath.Base(key.Filename)
+			want = append(want, key)
+		}
+		have := index.LookupLine(test.filename, test.line)
+		if diff := cmp.Diff(want, have); diff != "" {
+			t.Errorf("LookupLine(%q, %d) mismatch (-want +have):\n%s", test.filename, test.line, diff)
+		}
+	}
+}
+
+// convertTestFrame is like convertTestKey, but it also parses the line number suffix.
+func convertTestFrame(s string) (Key, int) {
+	i := strings.LastIndexByte(s, ':')
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		panic(err)
+	}
+	return convertTestKey(s[:i]), line
+}
@@ -12,3 +12,10 @@ func formatFuncName(pkgName, typeName, funcName string) string {
 	}
 	return funcName
 }
+
+func minInt(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}